@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+)
+
+// blobBucket holds the manifests of blobs under their content ID. Like the
+// chunk bucket its name starts with a dot, which no bucket may be created
+// with, so blobs stay out of listings.
+const blobBucket = ".blobs"
+
+var (
+	ErrInvalidBlobID    = errors.New("invalid blob id")
+	ErrChecksumMismatch = errors.New("content does not match its checksum")
+)
+
+func blobKey(cid string) string {
+	return objectKey(blobBucket, cid)
+}
+
+func validBlobID(cid string) error {
+	if b, err := hex.DecodeString(cid); err != nil || len(b) != sha256.Size {
+		return fmt.Errorf("%w: %s", ErrInvalidBlobID, cid)
+	}
+	return nil
+}
+
+// PutBlob stores the content of r as an immutable blob and returns its ID,
+// the hex SHA-256 of the content. Blobs are replicated and encrypted like the
+// objects of the default bucket, storing the same content twice keeps one copy.
+func (s *FileServer) PutBlob(r io.Reader) (string, error) {
+	cfg, err := s.bucket(DefaultBucket)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	hold := pendingRef()
+	manifest, err := s.storeChunks(cfg, s.chunker(cfg.Chunking, io.TeeReader(r, hash)), Manifest{}, hold)
+	// the chunks stay if the blob references them
+	defer s.release(hold, manifest)
+	if err != nil {
+		return "", err
+	}
+	cid := hex.EncodeToString(hash.Sum(nil))
+	key := blobKey(cid)
+
+	if s.store.Has(key) {
+		log.Printf("[%s] blob [%s] already stored\n", s.Transport.ListenAddr(), cid)
+		return cid, nil
+	}
+
+	b, err := encodeManifest(manifest)
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.store.writeObject(key, key, manifest.Size, bytes.NewReader(b)); err != nil {
+		return "", err
+	}
+	if err := s.retain(key, manifest); err != nil {
+		return "", err
+	}
+	return cid, s.replicate(cfg, key, manifest.Size, b)
+}
+
+// GetBlob returns the content of a blob, fetching it from the network if
+// needed. The content is verified against cid while it is read, the reader
+// fails with an IntegrityError at the end of a corrupt blob.
+func (s *FileServer) GetBlob(cid string) (io.Reader, error) {
+	if err := validBlobID(cid); err != nil {
+		return nil, err
+	}
+	cfg, err := s.bucket(DefaultBucket)
+	if err != nil {
+		return nil, err
+	}
+	key := blobKey(cid)
+
+	if !s.store.Has(key) {
+		if err := s.fetch(cfg, key); err != nil {
+			return nil, err
+		}
+	}
+
+	_, r, err := s.store.readStream(key)
+	if err != nil {
+		return nil, err
+	}
+	manifest, ok, _, err := readManifest(r)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("blob [%s] has no manifest", cid)
+	}
+
+	return &verifyReader{
+		r:    &chunkReader{s: s, cfg: cfg, manifest: manifest, chunks: manifest.Chunks},
+		hash: sha256.New(),
+		want: cid,
+		key:  key,
+	}, nil
+}
+
+// verifyReader hashes what is read from r and checks the hash against want
+// once r is exhausted.
+type verifyReader struct {
+	r    io.Reader
+	hash hash.Hash
+	want string
+	key  string // named by the error
+}
+
+func (v *verifyReader) Read(b []byte) (int, error) {
+	n, err := v.r.Read(b)
+	v.hash.Write(b[:n])
+	if err == io.EOF {
+		if have := hex.EncodeToString(v.hash.Sum(nil)); have != v.want {
+			return n, &IntegrityError{Key: v.key, Want: v.want, Have: have}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/vasanthgk02/distributed_file_system/p2p"
+)
+
+// newTestServer returns a server without peers storing below a temporary
+// directory, which is removed with the server by the returned func.
+func newTestServer(t *testing.T) (*FileServer, func()) {
+	root, err := os.MkdirTemp("", "dfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewFileServer(FileServerOpts{
+		EncKey:            newEncryptionKey(),
+		StorageRoot:       root,
+		PathTransfromFunc: CASPathTransform,
+		Transport:         p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddress: ":0"}),
+		ChunkSize:         8,
+	})
+	return s, func() {
+		s.store.Close()
+		os.RemoveAll(root)
+	}
+}
+
+func TestBlobRoundTrip(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	data := []byte("content addressed blob spanning several chunks")
+	hash := sha256.Sum256(data)
+	want := hex.EncodeToString(hash[:])
+
+	cid, err := s.PutBlob(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cid != want {
+		t.Errorf("have id %s want %s", cid, want)
+	}
+
+	// storing the same content again yields the same blob
+	again, err := s.PutBlob(bytes.NewReader(data))
+	if err != nil || again != cid {
+		t.Errorf("have id %s err %v want %s", again, err, cid)
+	}
+	infos, _ := s.store.List(objectKey(blobBucket, ""))
+	if len(infos) != 1 {
+		t.Errorf("have %d blobs want 1", len(infos))
+	}
+
+	r, err := s.GetBlob(cid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Errorf("have %s want %s", out, data)
+	}
+
+	if _, err := s.GetBlob("not-a-blob-id"); !errors.Is(err, ErrInvalidBlobID) {
+		t.Errorf("have %v want %v", err, ErrInvalidBlobID)
+	}
+}
+
+func TestVerifyReader(t *testing.T) {
+	hash := sha256.Sum256([]byte("expected"))
+	r := &verifyReader{
+		r:    bytes.NewReader([]byte("tampered")),
+		hash: sha256.New(),
+		want: hex.EncodeToString(hash[:]),
+		key:  "doc",
+	}
+	_, err := io.ReadAll(r)
+	var ie *IntegrityError
+	if !errors.Is(err, ErrChecksumMismatch) || !errors.As(err, &ie) || ie.Key != "doc" {
+		t.Errorf("have %v want an integrity error of doc", err)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vasanthgk02/distributed_file_system/p2p"
+)
+
+// DefaultBucket holds the keys stored without naming a bucket. It always
+// exists and replicates encrypted copies to every peer.
+const DefaultBucket = "default"
+
+const bucketsFileName = ".buckets.json"
+
+// RetentionInterval is how often a node looks for objects to expire.
+var RetentionInterval = time.Minute
+
+var (
+	ErrBucketNotFound = errors.New("bucket does not exist")
+	ErrQuotaExceeded  = errors.New("bucket quota exceeded")
+)
+
+// BucketConfig holds the per bucket settings. Every node keeps a copy of all
+// of them, the newest UpdatedAt wins when two nodes disagree.
+type BucketConfig struct {
+	Name string
+
+	// ReplicationFactor is the number of peers an object is replicated to,
+	// 0 replicates to every peer.
+	ReplicationFactor int
+
+	// Encrypt encrypts the copies sent to peers.
+	Encrypt bool
+
+	// Convergent encrypts copies with a key derived from their content and
+	// the master key, so the same content encrypts to the same bytes on every
+	// node. It needs Encrypt. Anyone who sees the copies learns which hold
+	// the same content, and can confirm a guess of the content by storing it
+	// too.
+	Convergent bool
+
+	// Quota is the maximum number of bytes the bucket may hold, 0 means no
+	// limit. It is enforced against the usage known to the storing node.
+	Quota int64
+
+	// Retention expires objects older than it, 0 keeps them forever.
+	Retention time.Duration
+
+	// DataShards and ParityShards switch the bucket from full replication to
+	// erasure coding. Every chunk is split into DataShards shards extended by
+	// ParityShards parity shards, each stored on a different peer, and any
+	// DataShards of them rebuild the chunk. ReplicationFactor then only
+	// applies to manifests.
+	DataShards   int
+	ParityShards int
+
+	// Chunking is how objects are cut into chunks, ChunkingFixed if unset.
+	Chunking Chunking
+
+	UpdatedAt time.Time
+}
+
+func defaultBucketConfig() BucketConfig {
+	return BucketConfig{Name: DefaultBucket, Encrypt: true}
+}
+
+func (c BucketConfig) ErasureCoded() bool {
+	return c.DataShards > 0 && c.ParityShards > 0
+}
+
+// validate rejects configs no node could store objects with. Configs from
+// peers are held to it like local ones.
+func (c BucketConfig) validate() error {
+	if err := validBucketName(c.Name); err != nil {
+		return err
+	}
+	if c.DataShards != 0 || c.ParityShards != 0 {
+		if _, err := NewReedSolomon(c.DataShards, c.ParityShards); err != nil {
+			return err
+		}
+	}
+	if err := validChunking(c.Chunking); err != nil {
+		return err
+	}
+	if c.Convergent && !c.Encrypt {
+		return fmt.Errorf("bucket [%s]: convergent encryption needs encryption", c.Name)
+	}
+	return nil
+}
+
+// validBucketName rejects names that cannot be told apart from keys, and
+// names starting with a dot, which are reserved for the buckets holding
+// chunks, shards, blobs and uploads.
+func validBucketName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/ ") || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid bucket name [%s]", name)
+	}
+	return nil
+}
+
+// objectKey is the key an object of bucket is stored under.
+func objectKey(bucket, key string) string {
+	return bucket + "/" + key
+}
+
+// splitObjectName splits "bucket/key" names as typed on the CLI. Names
+// without a bucket belong to the DefaultBucket.
+func splitObjectName(name string) (bucket, key string) {
+	if bucket, key, ok := strings.Cut(name, "/"); ok {
+		return bucket, key
+	}
+	return DefaultBucket, name
+}
+
+// BucketRegistry persists the bucket configs of the cluster on local disk.
+type BucketRegistry struct {
+	mu      sync.RWMutex
+	path    string
+	buckets map[string]BucketConfig
+}
+
+func NewBucketRegistry(root string) *BucketRegistry {
+	r := &BucketRegistry{
+		path:    fmt.Sprintf("%s/%s", root, bucketsFileName),
+		buckets: make(map[string]BucketConfig),
+	}
+
+	b, err := os.ReadFile(r.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("unable to read bucket configs: %s\n", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &r.buckets); err != nil {
+			log.Printf("unable to decode bucket configs: %s\n", err)
+		}
+	}
+	if _, ok := r.buckets[DefaultBucket]; !ok {
+		r.buckets[DefaultBucket] = defaultBucketConfig()
+	}
+	return r
+}
+
+func (r *BucketRegistry) Get(name string) (BucketConfig, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	cfg, ok := r.buckets[name]
+	return cfg, ok
+}
+
+func (r *BucketRegistry) All() []BucketConfig {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	cfgs := make([]BucketConfig, 0, len(r.buckets))
+	for _, cfg := range r.buckets {
+		cfgs = append(cfgs, cfg)
+	}
+	sort.Slice(cfgs, func(i, j int) bool { return cfgs[i].Name < cfgs[j].Name })
+	return cfgs
+}
+
+// Put records cfg unless a newer config of the bucket is already known. It
+// reports whether cfg was applied.
+func (r *BucketRegistry) Put(cfg BucketConfig) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if cur, ok := r.buckets[cfg.Name]; ok && !cfg.UpdatedAt.After(cur.UpdatedAt) {
+		return false, nil
+	}
+	r.buckets[cfg.Name] = cfg
+
+	b, err := json.Marshal(r.buckets)
+	if err != nil {
+		return true, err
+	}
+	if err := os.MkdirAll(strings.TrimSuffix(r.path, bucketsFileName), os.ModePerm); err != nil {
+		return true, err
+	}
+	return true, os.WriteFile(r.path, b, 0644)
+}
+
+type MessageBucket struct {
+	Config BucketConfig
+}
+
+// PutBucket creates or updates a bucket and announces it to every peer.
+func (s *FileServer) PutBucket(cfg BucketConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	cfg.UpdatedAt = time.Now()
+	if _, err := s.buckets.Put(cfg); err != nil {
+		return err
+	}
+
+	msg := Message{
+		Payload: MessageBucket{Config: cfg},
+	}
+	return s.broadCast(&msg)
+}
+
+func (s *FileServer) Buckets() []BucketConfig {
+	return s.buckets.All()
+}
+
+func (s *FileServer) bucket(name string) (BucketConfig, error) {
+	cfg, ok := s.buckets.Get(name)
+	if !ok {
+		return BucketConfig{}, fmt.Errorf("%w: %s", ErrBucketNotFound, name)
+	}
+	return cfg, nil
+}
+
+func (s *FileServer) handleMessageBucket(from string, msg MessageBucket) error {
+	if err := msg.Config.validate(); err != nil {
+		return fmt.Errorf("bucket from %s: %w", from, err)
+	}
+	applied, err := s.buckets.Put(msg.Config)
+	if applied {
+		log.Printf("[%s] bucket [%s] updated by %s\n", s.Transport.ListenAddr(), msg.Config.Name, from)
+	}
+	return err
+}
+
+// syncBuckets sends all known bucket configs to a newly connected peer.
+func (s *FileServer) syncBuckets(peer p2p.Peer) {
+	for _, cfg := range s.buckets.All() {
+		msg := Message{
+			Payload: MessageBucket{Config: cfg},
+		}
+		if err := s.send(peer, &msg); err != nil {
+			log.Printf("unable to sync bucket [%s] with [%s]: %s\n", cfg.Name, peer.RemoteAddr(), err)
+		}
+	}
+}
+
+// usage returns the bytes of bucket known to this node. Every object is
+// counted once, no matter how many copies the node holds.
+func (s *FileServer) usage(bucket string) int64 {
+	infos, _ := s.store.List(objectKey(bucket, ""))
+	merged := make(map[string]ObjectInfo)
+	mergeInfos(merged, infos)
+
+	var total int64
+	for _, info := range merged {
+		total += info.Size
+	}
+	return total
+}
+
+// quotaLeft returns the bytes key may take in bucket before the quota of
+// cfg is exceeded. The version of key it replaces does not count, it stays
+// until the new one fits.
+func (s *FileServer) quotaLeft(cfg BucketConfig, bucket, key string) int64 {
+	var replaced int64
+	if info, err := s.store.Stat(key); err == nil {
+		replaced = info.Size
+	}
+	return cfg.Quota - s.usage(bucket) + replaced
+}
+
+// quotaChunker fails with ErrQuotaExceeded as soon as the chunks cut by the
+// chunker add up to more than left bytes, before the chunk over the quota is
+// stored.
+type quotaChunker struct {
+	chunker
+	bucket string
+	quota  int64
+	left   int64
+}
+
+// limitChunks returns c failing once it cut more than the bytes key may take
+// in bucket, or c itself if cfg sets no quota. Bytes already stored count
+// against the quota too.
+func (s *FileServer) limitChunks(cfg BucketConfig, bucket, key string, stored int64, c chunker) chunker {
+	if cfg.Quota <= 0 {
+		return c
+	}
+	return &quotaChunker{chunker: c, bucket: bucket, quota: cfg.Quota, left: s.quotaLeft(cfg, bucket, key) - stored}
+}
+
+func (q *quotaChunker) Next() ([]byte, error) {
+	chunk, err := q.chunker.Next()
+	q.left -= int64(len(chunk))
+	if err == nil && q.left < 0 {
+		return nil, fmt.Errorf("%w: %s holds more than %d bytes", ErrQuotaExceeded, q.bucket, q.quota)
+	}
+	return chunk, err
+}
+
+// retentionLoop expires objects every RetentionInterval until the server stops.
+func (s *FileServer) retentionLoop() {
+	ticker := time.NewTicker(RetentionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.expireObjects()
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// expireObjects deletes the local copies of objects that outlived the
+// retention of their bucket. Every node expires its own copies.
+func (s *FileServer) expireObjects() {
+	for _, cfg := range s.buckets.All() {
+		if cfg.Retention <= 0 {
+			continue
+		}
+		deadline := time.Now().Add(-cfg.Retention)
+		for _, entry := range s.store.index.Entries(objectKey(cfg.Name, "")) {
+			if entry.ModTime.After(deadline) {
+				continue
+			}
+			log.Printf("[%s] expiring [%s] past the retention of bucket [%s]\n", s.Transport.ListenAddr(), entry.Name, cfg.Name)
+			manifest, ok := s.localManifest(entry.Key)
+			if err := s.store.Delete(entry.Key); err != nil {
+				log.Printf("unable to expire [%s]: %s\n", entry.Name, err)
+				continue
+			}
+			if ok && entry.Key == entry.Name && !entry.Cached {
+				s.release(entry.Name, manifest)
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestBucketRegistry(t *testing.T) {
+	root := t.TempDir()
+	r := NewBucketRegistry(root)
+
+	if _, ok := r.Get(DefaultBucket); !ok {
+		t.Fatalf("expected the %s bucket to exist", DefaultBucket)
+	}
+
+	now := time.Now()
+	cfg := BucketConfig{Name: "logs", ReplicationFactor: 2, UpdatedAt: now}
+	if applied, err := r.Put(cfg); err != nil || !applied {
+		t.Fatalf("expected config to be applied: %v", err)
+	}
+
+	stale := BucketConfig{Name: "logs", ReplicationFactor: 5, UpdatedAt: now.Add(-time.Second)}
+	if applied, _ := r.Put(stale); applied {
+		t.Errorf("expected stale config to be ignored")
+	}
+
+	reloaded := NewBucketRegistry(root)
+	got, ok := reloaded.Get("logs")
+	if !ok || got.ReplicationFactor != 2 {
+		t.Errorf("want persisted rf 2, have %+v", got)
+	}
+}
+
+func TestSplitObjectName(t *testing.T) {
+	for name, want := range map[string][2]string{
+		"doc":          {DefaultBucket, "doc"},
+		"logs/today":   {"logs", "today"},
+		"logs/a/b.txt": {"logs", "a/b.txt"},
+	} {
+		bucket, key := splitObjectName(name)
+		if bucket != want[0] || key != want[1] {
+			t.Errorf("%s: have (%s, %s) want (%s, %s)", name, bucket, key, want[0], want[1])
+		}
+	}
+}
+
+func TestQuotaOverwrite(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	if err := s.PutBucket(BucketConfig{Name: "small", Quota: 16}); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("fits in quota")
+	if err := s.Store("small", "doc", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the object being replaced does not count against its replacement
+	if err := s.Store("small", "doc", bytes.NewReader([]byte("also fits quota"))); err != nil {
+		t.Fatalf("have %v for an overwrite within quota", err)
+	}
+	if err := s.Store("small", "doc", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	err := s.Store("small", "doc", bytes.NewReader([]byte("far too large for the quota")))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("have %v want %v", err, ErrQuotaExceeded)
+	}
+	r, err := s.Get("small", "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := io.ReadAll(r); !bytes.Equal(out, data) {
+		t.Errorf("have %q want the original %q kept", out, data)
+	}
+	manifest, _ := s.localManifest(objectKey("small", "doc"))
+	for _, key := range manifestKeys(manifest) {
+		if entry, _ := s.store.index.Get(key); len(entry.Refs) != 1 {
+			t.Errorf("have refs %v of [%s] want the original only", entry.Refs, key)
+		}
+	}
+}
+
+func TestQuotaRejectedStoreLeavesNoChunks(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	if err := s.PutBucket(BucketConfig{Name: "small", Quota: 16}); err != nil {
+		t.Fatal(err)
+	}
+	err := s.Store("small", "doc", bytes.NewReader([]byte("five chunks of 8 bytes, 40 bytes")))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("have %v want %v", err, ErrQuotaExceeded)
+	}
+	if entries := s.store.index.Entries(chunkBucket + "/"); len(entries) != 0 {
+		t.Errorf("have %d chunk(s) left behind by a rejected store", len(entries))
+	}
+}
+
+func TestReservedBucketNames(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	for _, name := range []string{chunkBucket, encShardBucket, convChunkBucket, uploadBucket, blobBucket, ".hidden", "a/b", ""} {
+		if err := s.PutBucket(BucketConfig{Name: name}); err == nil {
+			t.Errorf("expected bucket [%s] to be rejected", name)
+		}
+	}
+	if err := s.PutBucket(BucketConfig{Name: "logs.old"}); err != nil {
+		t.Errorf("have %v for a dot inside the name", err)
+	}
+}
+
+func TestBucketFromPeerValidated(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	for _, cfg := range []BucketConfig{
+		{Name: ".chunks"},
+		{Name: "rs", DataShards: 3, ParityShards: -1},
+		{Name: "cdc", Chunking: "rolling"},
+		{Name: "conv", Convergent: true},
+	} {
+		if err := s.handleMessageBucket("peer", MessageBucket{Config: cfg}); err == nil {
+			t.Errorf("expected %+v from a peer to be rejected", cfg)
+		}
+		if _, err := s.bucket(cfg.Name); err == nil {
+			t.Errorf("expected bucket [%s] not to be stored", cfg.Name)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"sort"
+	"sync"
+)
+
+// Copies a node fetches to serve reads are cached rather than owned. They are
+// flagged as such in the index, kept apart from the data the node stores and
+// replicates, and the least recently used ones are evicted once they take
+// more than FileServerOpts.CacheSize bytes.
+
+// CacheStats reports the cache of fetched copies of a node.
+type CacheStats struct {
+	Entries   int
+	Bytes     int64
+	Budget    int64  // bytes the cache may take, unbounded if zero
+	Hits      uint64 // reads served from cached copies
+	Misses    uint64 // reads of data the node neither cached nor holds
+	Evictions uint64
+}
+
+// HitRatio is the share of reads served from the cache, 0 before any read.
+func (c CacheStats) HitRatio() float64 {
+	if c.Hits+c.Misses == 0 {
+		return 0
+	}
+	return float64(c.Hits) / float64(c.Hits+c.Misses)
+}
+
+type cacheItem struct {
+	key  string
+	size int64
+}
+
+// objectCache keeps the cached keys in LRU order and their bytes within the
+// budget. It only tracks keys, the store holds the copies.
+type objectCache struct {
+	mu     sync.Mutex
+	budget int64
+	bytes  int64
+	lru    *list.List // of *cacheItem, most recently used first
+	items  map[string]*list.Element
+	pins   map[string]int // keys being read, which are not evicted
+
+	hits, misses, evictions uint64
+}
+
+func newObjectCache(budget int64) *objectCache {
+	return &objectCache{
+		budget: budget,
+		lru:    list.New(),
+		items:  make(map[string]*list.Element),
+		pins:   make(map[string]int),
+	}
+}
+
+// add records key, taking size bytes, as used just now. It returns the least
+// recently used keys that no longer fit the budget, which are dropped from the
+// cache and are to be deleted by the caller. key itself and pinned keys are
+// kept even if they do not fit, they are about to be read.
+func (c *objectCache) add(key string, size int64) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if ok {
+		item := el.Value.(*cacheItem)
+		c.bytes += size - item.size
+		item.size = size
+		c.lru.MoveToFront(el)
+	} else {
+		el = c.lru.PushFront(&cacheItem{key: key, size: size})
+		c.items[key] = el
+		c.bytes += size
+	}
+
+	var evicted []string
+	for back := c.lru.Back(); c.budget > 0 && c.bytes > c.budget && back != el; {
+		item := back.Value.(*cacheItem)
+		prev := back.Prev()
+		if c.pins[item.key] == 0 {
+			c.lru.Remove(back)
+			delete(c.items, item.key)
+			c.bytes -= item.size
+			c.evictions++
+			evicted = append(evicted, item.key)
+		}
+		back = prev
+	}
+	return evicted
+}
+
+// pin keeps key from being evicted until it is unpinned as often.
+func (c *objectCache) pin(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pins[key]++
+}
+
+func (c *objectCache) unpin(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pins[key]--; c.pins[key] <= 0 {
+		delete(c.pins, key)
+	}
+}
+
+// hit reports whether key is cached, counting a hit and marking it as used
+// if so.
+func (c *objectCache) hit(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if ok {
+		c.hits++
+		c.lru.MoveToFront(el)
+	}
+	return ok
+}
+
+func (c *objectCache) miss() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.misses++
+}
+
+func (c *objectCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.bytes -= c.lru.Remove(el).(*cacheItem).size
+		delete(c.items, key)
+	}
+}
+
+func (c *objectCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{
+		Entries:   c.lru.Len(),
+		Bytes:     c.bytes,
+		Budget:    c.budget,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+// loadCache fills the cache with the cached copies on disk. How recently they
+// were used is not persisted, so the oldest count as least recently used.
+func (s *FileServer) loadCache() {
+	var entries []IndexEntry
+	for _, entry := range s.store.index.Entries("") {
+		if entry.Cached {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime.Before(entries[j].ModTime)
+	})
+	for _, entry := range entries {
+		for _, key := range s.cache.add(entry.Key, entry.Size) {
+			s.evict(key)
+		}
+	}
+}
+
+// cacheFetched flags key, fetched to serve a read, as cached and evicts what
+// no longer fits the cache.
+func (s *FileServer) cacheFetched(key string) {
+	entry, ok := s.store.index.Get(key)
+	if !ok {
+		return
+	}
+	if !entry.Cached {
+		entry.Cached = true
+		if _, err := s.store.index.Put(entry); err != nil {
+			log.Printf("[%s] unable to cache [%s]: %s\n", s.Transport.ListenAddr(), key, err)
+			return
+		}
+	}
+	for _, key := range s.cache.add(key, entry.Size) {
+		s.evict(key)
+	}
+}
+
+// ownCopy turns a cached copy of key into one this node owns, which is never
+// evicted.
+func (s *FileServer) ownCopy(key string) {
+	entry, ok := s.store.index.Get(key)
+	if !ok || !entry.Cached {
+		return
+	}
+	entry.Cached = false
+	if _, err := s.store.index.Put(entry); err != nil {
+		log.Printf("[%s] unable to take over cached [%s]: %s\n", s.Transport.ListenAddr(), key, err)
+	}
+	s.cache.remove(key)
+}
+
+// evict deletes the copy of key unless it is no longer a cached one.
+func (s *FileServer) evict(key string) {
+	if entry, ok := s.store.index.Get(key); !ok || !entry.Cached {
+		return
+	}
+	log.Printf("[%s] evicting cached [%s]\n", s.Transport.ListenAddr(), key)
+	if err := s.store.Delete(key); err != nil {
+		log.Printf("[%s] unable to evict [%s]: %s\n", s.Transport.ListenAddr(), key, err)
+	}
+}
+
+// account counts a read of key as a hit when a cached copy serves it, and as
+// a miss when the node holds no copy of key at all.
+func (s *FileServer) account(key string) {
+	switch {
+	case s.store.Has(key):
+		s.cache.hit(key)
+	case !s.store.Has(hashKey(key)):
+		s.cache.miss()
+	}
+}
+
+func (s *FileServer) CacheStats() CacheStats {
+	return s.cache.stats()
+}
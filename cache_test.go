@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+func TestObjectCacheLRU(t *testing.T) {
+	c := newObjectCache(10)
+
+	if evicted := c.add("a", 4); len(evicted) != 0 {
+		t.Errorf("have evicted %v want none", evicted)
+	}
+	c.add("b", 4)
+	if !c.hit("a") || c.hit("x") {
+		t.Error("expected a hit on a and none on x")
+	}
+
+	// b is least recently used since a was hit
+	if evicted := c.add("c", 4); !slices.Equal(evicted, []string{"b"}) {
+		t.Errorf("have evicted %v want [b]", evicted)
+	}
+
+	// a key larger than the budget is kept until the next one comes in
+	if evicted := c.add("big", 20); !slices.Equal(evicted, []string{"a", "c"}) {
+		t.Errorf("have evicted %v want [a c]", evicted)
+	}
+	if evicted := c.add("d", 1); !slices.Equal(evicted, []string{"big"}) {
+		t.Errorf("have evicted %v want [big]", evicted)
+	}
+
+	// a pinned key is passed over while it is read
+	c.pin("d")
+	if evicted := c.add("e", 10); len(evicted) != 0 {
+		t.Errorf("have evicted %v want none", evicted)
+	}
+	c.unpin("d")
+	if evicted := c.add("f", 1); !slices.Equal(evicted, []string{"d", "e"}) {
+		t.Errorf("have evicted %v want [d e]", evicted)
+	}
+
+	c.miss()
+	stats := c.stats()
+	if stats.Entries != 1 || stats.Bytes != 1 || stats.Hits != 1 || stats.Misses != 1 || stats.Evictions != 6 {
+		t.Errorf("have %+v", stats)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	s.cache = newObjectCache(20)
+
+	write := func(key string) {
+		if _, err := s.store.Write(key, bytes.NewReader(make([]byte, 8))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an owned copy is never evicted, even when it was cached before
+	write("owned")
+	s.cacheFetched("owned")
+	s.ownCopy("owned")
+
+	for _, key := range []string{"a", "b", "c"} {
+		write(key)
+		s.cacheFetched(key)
+	}
+	if s.store.Has("a") || !s.store.Has("b") || !s.store.Has("c") || !s.store.Has("owned") {
+		t.Error("expected only the least recently used copy to be evicted")
+	}
+	if entry, _ := s.store.index.Get("b"); !entry.Cached {
+		t.Error("expected b to be flagged as cached")
+	}
+
+	s.account("b")
+	s.account("owned")
+	s.account("missing")
+	if stats := s.CacheStats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("have %d hits %d misses want 1 and 1", stats.Hits, stats.Misses)
+	}
+}
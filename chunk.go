@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+
+	"github.com/vasanthgk02/distributed_file_system/p2p"
+)
+
+// DefaultChunkSize is the size objects are split into when FileServerOpts
+// does not set one.
+const DefaultChunkSize int64 = 4 << 20
+
+// chunkBucket holds the chunks of all objects. Names starting with a dot are
+// reserved by validBucketName, so chunks never show up in the listing of a
+// bucket.
+const chunkBucket = ".chunks"
+
+// shardBucket holds the shards of erasure coded chunks.
+const shardBucket = ".shards"
+
+// encChunkBucket and encShardBucket hold the chunks and shards of encrypted
+// objects. Replicas of those are encrypted, so they cannot be shared with
+// plain objects of the same content.
+const (
+	encChunkBucket = ".chunks-enc"
+	encShardBucket = ".shards-enc"
+)
+
+// convChunkBucket and convShardBucket hold the chunks and shards of objects
+// encrypted convergently. Sharing those with other encrypted objects would
+// reveal which of these hold the same content.
+const (
+	convChunkBucket = ".chunks-conv"
+	convShardBucket = ".shards-conv"
+)
+
+// manifestMagic starts every manifest, objects stored before chunking do not
+// have it and are served as they are.
+const manifestMagic = "dfs-manifest/1\n"
+
+// ChunkRef points at a chunk by the hex SHA-256 of its content.
+type ChunkRef struct {
+	ID   string
+	Size int64
+}
+
+// Manifest is stored under the key of an object and lists its chunks in order.
+// Chunks of erasure coded objects are only stored as shards.
+type Manifest struct {
+	Size     int64
+	Checksum string // hex SHA-256 of the object, empty on older manifests and multipart uploads
+	Chunks   []ChunkRef
+
+	DataShards   int
+	ParityShards int
+
+	Encrypted  bool // chunks are replicated encrypted, false on older manifests
+	Convergent bool // and encrypted convergently
+}
+
+func (m Manifest) ErasureCoded() bool {
+	return m.DataShards > 0 && m.ParityShards > 0
+}
+
+// chunkKey is the key of chunk id of an object stored with m.
+func (m Manifest) chunkKey(id string) string {
+	if m.Convergent {
+		return objectKey(convChunkBucket, id)
+	}
+	if m.Encrypted {
+		return objectKey(encChunkBucket, id)
+	}
+	return objectKey(chunkBucket, id)
+}
+
+// shardKey is the key of shard i of chunk id of an object stored with m.
+func (m Manifest) shardKey(id string, i int) string {
+	bucket := shardBucket
+	switch {
+	case m.Convergent:
+		bucket = convShardBucket
+	case m.Encrypted:
+		bucket = encShardBucket
+	}
+	return fmt.Sprintf("%s.%d", objectKey(bucket, id), i)
+}
+
+func encodeManifest(m Manifest) ([]byte, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(manifestMagic), b...), nil
+}
+
+// readManifest decodes the manifest at the start of r. ok is false when r
+// holds an object stored before chunking, the returned reader then yields the
+// object in full.
+func readManifest(r io.Reader) (m Manifest, ok bool, rest io.Reader, err error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(manifestMagic))
+	if err != nil && err != io.EOF {
+		return m, false, nil, err
+	}
+	if string(magic) != manifestMagic {
+		return m, false, br, nil
+	}
+
+	br.Discard(len(manifestMagic))
+	if err := json.NewDecoder(br).Decode(&m); err != nil {
+		return m, false, nil, fmt.Errorf("corrupt manifest: %w", err)
+	}
+	return m, true, nil, nil
+}
+
+// chunker returns a chunker cutting r into chunks of the configured size, or
+// of that size on average for ChunkingCDC.
+func (s *FileServer) chunker(c Chunking, r io.Reader) chunker {
+	chunkSize := s.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	return newChunker(c, chunkSize, r)
+}
+
+// storeChunks stores every chunk cut by c locally and on the peers placed for
+// it, and returns the manifest listing them. Only one chunk is held in memory
+// at a time, and chunks already stored for another object or by an earlier
+// attempt are neither written nor sent again. Every chunk is referenced by
+// hold as soon as it is stored, the caller releases hold once the object
+// references the chunks, or once the store failed, which deletes the chunks
+// no other object references. Chunks that changed since old, the manifest
+// the object replaces, are sent to peers as deltas where possible.
+func (s *FileServer) storeChunks(cfg BucketConfig, c chunker, old Manifest, hold string) (Manifest, error) {
+	return s.storeChunksFrom(cfg, c, old, newManifest(cfg), sha256.New(), hold, nil)
+}
+
+// pendingRef returns a new object name to hold the chunks of an object being
+// stored with until the object references them.
+func pendingRef() string {
+	return objectKey(".pending", newTransferID())
+}
+
+// newManifest returns the empty manifest of an object stored in a bucket with
+// cfg.
+func newManifest(cfg BucketConfig) Manifest {
+	m := Manifest{Encrypted: cfg.Encrypt, Convergent: cfg.Convergent}
+	if cfg.ErasureCoded() {
+		m.DataShards = cfg.DataShards
+		m.ParityShards = cfg.ParityShards
+	}
+	return m
+}
+
+// storeChunksFrom is storeChunks continuing after the chunks manifest already
+// lists, whose content hash has seen. done, if set, is called with the
+// manifest after every chunk stored.
+func (s *FileServer) storeChunksFrom(cfg BucketConfig, c chunker, old, manifest Manifest, hash hash.Hash, hold string, done func(Manifest) error) (Manifest, error) {
+	if old.Encrypted != manifest.Encrypted || old.Convergent != manifest.Convergent {
+		// replicas of old cannot be the basis of differently encrypted chunks
+		old = Manifest{}
+	}
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			manifest.Checksum = hex.EncodeToString(hash.Sum(nil))
+			return manifest, nil
+		}
+		if err != nil {
+			return manifest, err
+		}
+
+		ref, err := s.storeChunk(cfg, manifest, chunk, basisAt(old, manifest.Size))
+		last := manifest
+		last.Chunks = []ChunkRef{ref}
+		if herr := s.retain(hold, last); err == nil {
+			err = herr
+		}
+		if err != nil {
+			// the copies that made it to disk or to some of the peers are not
+			// in the manifest returned, they go right away
+			s.release(hold, last)
+			return manifest, err
+		}
+		manifest.Chunks = append(manifest.Chunks, ref)
+		manifest.Size += ref.Size
+		hash.Write(chunk)
+		if done != nil {
+			if err := done(manifest); err != nil {
+				return manifest, err
+			}
+		}
+	}
+}
+
+// storeChunk stores chunk of the object being stored with m and replicates it
+// to the peers lacking it. Peers holding basis are sent a delta against it.
+func (s *FileServer) storeChunk(cfg BucketConfig, m Manifest, chunk []byte, basis string) (ChunkRef, error) {
+	hash := sha256.Sum256(chunk)
+	ref := ChunkRef{ID: hex.EncodeToString(hash[:]), Size: int64(len(chunk))}
+	key := m.chunkKey(ref.ID)
+
+	if cfg.ErasureCoded() {
+		return ref, s.storeShards(cfg, m, ref, chunk)
+	}
+
+	if s.store.Has(key) {
+		s.ownCopy(key)
+	} else if _, err := s.store.Write(key, bytes.NewReader(chunk)); err != nil {
+		return ref, err
+	}
+	peers := s.lacking(s.placePeers(key, cfg.ReplicationFactor), key)
+	if basis != "" && basis != key && len(peers) > 0 {
+		peers = s.sendDeltas(cfg, peers, basis, key, chunk)
+	}
+	return ref, s.replicateTo(peers, cfg, key, ref.Size, chunk)
+}
+
+// storeShards erasure codes a chunk and sends every shard to its own peer.
+// The chunk itself is not kept, that is what saves the disk.
+func (s *FileServer) storeShards(cfg BucketConfig, m Manifest, ref ChunkRef, chunk []byte) error {
+	rs, err := NewReedSolomon(cfg.DataShards, cfg.ParityShards)
+	if err != nil {
+		return err
+	}
+	shards := rs.Split(chunk)
+	if err := rs.Encode(shards); err != nil {
+		return err
+	}
+
+	peers, err := s.placeShards(m.chunkKey(ref.ID), len(shards))
+	if err != nil {
+		return err
+	}
+
+	for i, shard := range shards {
+		key := m.shardKey(ref.ID, i)
+		if err := s.replicateTo(s.lacking([]p2p.Peer{peers[i]}, key), cfg, key, int64(len(shard)), shard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildChunk rebuilds an erasure coded chunk and stores it locally.
+func (s *FileServer) rebuildChunk(cfg BucketConfig, m Manifest, ref ChunkRef) error {
+	chunk, err := s.reconstructChunk(cfg, m, ref)
+	if err != nil {
+		return err
+	}
+	_, err = s.store.Write(m.chunkKey(ref.ID), bytes.NewReader(chunk))
+	return err
+}
+
+// reconstructChunk fetches shards of an erasure coded chunk until enough
+// arrived to reconstruct it.
+func (s *FileServer) reconstructChunk(cfg BucketConfig, m Manifest, ref ChunkRef) ([]byte, error) {
+	rs, err := NewReedSolomon(m.DataShards, m.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		shards = make([][]byte, m.DataShards+m.ParityShards)
+		have   = 0
+	)
+	for i := range shards {
+		if have == m.DataShards {
+			break
+		}
+		key := m.shardKey(ref.ID, i)
+		if shard, ok := s.readReplica(cfg, key); ok {
+			shards[i] = shard
+			have++
+			continue
+		}
+		if err := s.fetch(cfg, key); err != nil {
+			log.Printf("[%s] shard %d of chunk [%s] unavailable: %s\n", s.Transport.ListenAddr(), i, ref.ID, err)
+			continue
+		}
+		_, r, err := s.store.readStream(key)
+		if err != nil {
+			return nil, err
+		}
+		shards[i], err = io.ReadAll(r)
+		r.Close()
+		s.store.Delete(key)
+		if err != nil {
+			return nil, err
+		}
+		have++
+	}
+
+	if err := rs.Reconstruct(shards); err != nil {
+		return nil, fmt.Errorf("chunk [%s]: %w", ref.ID, err)
+	}
+	return rs.Join(shards, int(ref.Size)), nil
+}
+
+// readReplica returns the data of key if this node holds a replica of it,
+// which is stored under the hashed key like on any other peer.
+func (s *FileServer) readReplica(cfg BucketConfig, key string) ([]byte, bool) {
+	b, err := s.readCopy(hashKey(key), cfg.Encrypt)
+	return b, err == nil
+}
+
+// readCopy reads the data stored under key, decrypting it if it was stored
+// encrypted.
+func (s *FileServer) readCopy(key string, encrypted bool) ([]byte, error) {
+	_, r, err := s.store.readStream(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	if !encrypted {
+		return io.ReadAll(r)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := copyDecrypt(s.Keystore, r, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// fetchChunk makes sure the chunk is on local disk, fetching or rebuilding it
+// from the network if needed, and verifies its content against its ID.
+func (s *FileServer) fetchChunk(cfg BucketConfig, m Manifest, ref ChunkRef) error {
+	key := m.chunkKey(ref.ID)
+	if s.store.Has(key) {
+		return nil
+	}
+
+	fetch := func() error { return s.fetchVerified(cfg, key, ref.ID) }
+	if m.ErasureCoded() {
+		fetch = func() error { return s.rebuildChunk(cfg, m, ref) }
+	}
+	if err := fetch(); err != nil {
+		return err
+	}
+
+	// rebuilt chunks are only checked here
+	entry, _ := s.store.index.Get(key)
+	if entry.Checksum != ref.ID {
+		s.store.Delete(key)
+		return &IntegrityError{Key: key, Want: ref.ID, Have: entry.Checksum}
+	}
+	s.cacheFetched(key)
+	return nil
+}
+
+// chunkReader streams the chunks of a manifest in order. Chunks being
+// downloaded by a swarm are waited for, others are fetched from the network
+// once the previous one has been read.
+type chunkReader struct {
+	s        *FileServer
+	cfg      BucketConfig
+	manifest Manifest
+	chunks   []ChunkRef
+	jobs     map[string]*swarmJob
+	cur      io.ReadCloser
+}
+
+// open opens the local copy of a chunk once its swarm job is done, fetching
+// it if the swarm does not cover it. The chunk is verified against its ID as
+// it is read.
+func (r *chunkReader) open(ref ChunkRef) (io.ReadCloser, error) {
+	if job, ok := r.jobs[ref.ID]; ok {
+		<-job.done
+		if job.err != nil {
+			return nil, job.err
+		}
+	}
+	key := r.manifest.chunkKey(ref.ID)
+	r.s.cache.pin(key)
+	defer r.s.cache.unpin(key)
+
+	// a chunk fetched ahead by the swarm may have been evicted from the
+	// cache by the chunks fetched after it, it is then fetched again
+	var (
+		f   io.ReadCloser
+		err error
+	)
+	for attempt := 0; attempt < 3; attempt++ {
+		if err = r.s.fetchChunk(r.cfg, r.manifest, ref); err != nil {
+			return nil, err
+		}
+		if _, f, err = r.s.store.readStream(key); !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return readCloser{
+		Reader: &verifyReader{r: f, hash: sha256.New(), want: ref.ID, key: key},
+		Closer: f,
+	}, nil
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			f, err := r.open(r.chunks[0])
+			if err != nil {
+				return 0, err
+			}
+			r.chunks = r.chunks[1:]
+			r.cur = f
+		}
+
+		n, err := r.cur.Read(b)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Close releases the chunk currently being read.
+func (r *chunkReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
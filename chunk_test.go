@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestManifestEncoding(t *testing.T) {
+	m := Manifest{
+		Size: 12,
+		Chunks: []ChunkRef{
+			{ID: "aa", Size: 8},
+			{ID: "bb", Size: 4},
+		},
+	}
+	b, err := encodeManifest(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	have, ok, _, err := readManifest(bytes.NewReader(b))
+	if err != nil || !ok {
+		t.Fatalf("expected a manifest, have ok=%v err=%v", ok, err)
+	}
+	if have.Size != m.Size || len(have.Chunks) != 2 || have.Chunks[1].ID != "bb" {
+		t.Errorf("have %+v want %+v", have, m)
+	}
+
+	// objects stored before chunking are passed through in full
+	legacy := []byte("plain old object")
+	_, ok, rest, err := readManifest(bytes.NewReader(legacy))
+	if err != nil || ok {
+		t.Fatalf("expected no manifest, have ok=%v err=%v", ok, err)
+	}
+	out, _ := io.ReadAll(rest)
+	if !bytes.Equal(out, legacy) {
+		t.Errorf("have %s want %s", out, legacy)
+	}
+}
+
+func TestGetCorruptChunk(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	data := []byte("an object whose second chunk rots on disk")
+	if err := s.Store(DefaultBucket, "doc", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	manifest, _ := s.localManifest(objectKey(DefaultBucket, "doc"))
+	key := manifest.chunkKey(manifest.Chunks[1].ID)
+	path := s.store.Root + "/" + CASPathTransform(key).FullPath()
+	if err := os.WriteFile(path, []byte("rotten!!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s.Get(DefaultBucket, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(r)
+	var ie *IntegrityError
+	if !errors.As(err, &ie) || ie.Key != key {
+		t.Errorf("have %v want an integrity error of [%s]", err, key)
+	}
+}
+
+func TestGetLegacyClosesFile(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	// written as a whole like objects stored before chunking
+	legacy := []byte("plain old object")
+	if _, err := s.store.Write(objectKey(DefaultBucket, "old"), bytes.NewReader(legacy)); err != nil {
+		t.Fatal(err)
+	}
+
+	open := func() int {
+		fds, _ := os.ReadDir("/proc/self/fd")
+		return len(fds)
+	}
+	before := open()
+	for range 10 {
+		r, err := s.Get(DefaultBucket, "old")
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(out, legacy) {
+			t.Fatalf("have %q, %v want %q", out, err, legacy)
+		}
+	}
+	if after := open(); after > before {
+		t.Errorf("have %d open files want %d", after, before)
+	}
+}
+
+func TestConvergentBucket(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	if err := s.PutBucket(BucketConfig{Name: "conv", Convergent: true}); err == nil {
+		t.Error("expected convergent encryption to need encryption")
+	}
+	cfg := BucketConfig{Name: "conv", Encrypt: true, Convergent: true}
+	if err := s.PutBucket(cfg); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("the same bytes in every bucket")
+	if err := s.Store("conv", "doc", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	manifest, _ := s.localManifest(objectKey("conv", "doc"))
+	key := manifest.chunkKey(manifest.Chunks[0].ID)
+	if !strings.HasPrefix(key, convChunkBucket+"/") {
+		t.Errorf("have chunk [%s] want it kept apart from other encrypted chunks", key)
+	}
+
+	// every node holding the chunk encrypts it the same
+	chunk := data[:manifest.Chunks[0].Size]
+	a, b := new(bytes.Buffer), new(bytes.Buffer)
+	s.encryptCopy(cfg, chunk, a)
+	s.encryptCopy(cfg, chunk, b)
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Error("expected the copies of the chunk to be the same")
+	}
+}
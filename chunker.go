@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Chunking selects how objects are cut into chunks.
+type Chunking string
+
+const (
+	// ChunkingFixed cuts chunks of exactly the chunk size.
+	ChunkingFixed Chunking = "fixed"
+
+	// ChunkingCDC cuts chunks where the content says so, using the chunk size
+	// as the average. Inserting bytes into an object only changes the chunks
+	// around the insertion, the others stay the same and are deduplicated.
+	ChunkingCDC Chunking = "cdc"
+)
+
+func validChunking(c Chunking) error {
+	switch c {
+	case "", ChunkingFixed, ChunkingCDC:
+		return nil
+	}
+	return fmt.Errorf("invalid chunking [%s]", c)
+}
+
+// chunker cuts a stream into chunks. The returned chunk is only valid until
+// the next call, the end of the stream is io.EOF.
+type chunker interface {
+	Next() ([]byte, error)
+}
+
+func newChunker(c Chunking, size int64, r io.Reader) chunker {
+	if c == ChunkingCDC {
+		return newCDCChunker(r, int(size))
+	}
+	return &fixedChunker{r: r, buf: make([]byte, size)}
+}
+
+type fixedChunker struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (c *fixedChunker) Next() ([]byte, error) {
+	n, err := io.ReadFull(c.r, c.buf)
+	if n > 0 && (err == nil || err == io.ErrUnexpectedEOF) {
+		return c.buf[:n], nil
+	}
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return nil, err
+}
+
+// gear maps every byte to a pseudo random value for the rolling hash. It is
+// fixed, chunk boundaries must be the same on every node and every run.
+var gear [256]uint64
+
+func init() {
+	// splitmix64
+	x := uint64(0x2545f4914f6cdd1d)
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// cdcChunker is a FastCDC chunker. A gear hash rolls over the last 64 bytes
+// and a chunk ends where its top bits are zero. Chunks are kept between a
+// quarter of and four times the average, and normalized around the average
+// by a harder mask before it and an easier one after.
+type cdcChunker struct {
+	r             *bufio.Reader
+	min, avg, max int
+	maskS, maskL  uint64
+	buf           []byte
+}
+
+func newCDCChunker(r io.Reader, avg int) *cdcChunker {
+	avg = max(avg, 64)
+	n := bits.Len(uint(avg)) - 1
+	return &cdcChunker{
+		r:     bufio.NewReader(r),
+		min:   avg / 4,
+		avg:   avg,
+		max:   avg * 4,
+		maskS: topBits(n + 1),
+		maskL: topBits(n - 1),
+		buf:   make([]byte, 0, avg*4),
+	}
+}
+
+func topBits(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+func (c *cdcChunker) Next() ([]byte, error) {
+	c.buf = c.buf[:0]
+
+	var hash uint64
+	for len(c.buf) < c.max {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			if len(c.buf) == 0 {
+				return nil, io.EOF
+			}
+			return c.buf, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+
+		// no cut point below the minimum, so no need to hash there either
+		if len(c.buf) < c.min {
+			continue
+		}
+		hash = hash<<1 + gear[b]
+		mask := c.maskS
+		if len(c.buf) >= c.avg {
+			mask = c.maskL
+		}
+		if hash&mask == 0 {
+			return c.buf, nil
+		}
+	}
+	return c.buf, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func cutChunks(t *testing.T, c chunker) [][]byte {
+	var chunks [][]byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, bytes.Clone(chunk))
+	}
+}
+
+func TestFixedChunker(t *testing.T) {
+	chunks := cutChunks(t, newChunker(ChunkingFixed, 8, bytes.NewReader(make([]byte, 20))))
+	if len(chunks) != 3 || len(chunks[0]) != 8 || len(chunks[2]) != 4 {
+		t.Errorf("have %d chunks want 8+8+4 bytes", len(chunks))
+	}
+}
+
+func TestCDCChunker(t *testing.T) {
+	const avg = 4096
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := cutChunks(t, newChunker(ChunkingCDC, avg, bytes.NewReader(data)))
+	if joined := bytes.Join(chunks, nil); !bytes.Equal(joined, data) {
+		t.Fatal("chunks do not add up to the data")
+	}
+	for i, chunk := range chunks[:len(chunks)-1] {
+		if len(chunk) < avg/4 || len(chunk) > avg*4 {
+			t.Errorf("chunk %d has %d bytes, out of bounds", i, len(chunk))
+		}
+	}
+
+	// inserting bytes near the start only changes the chunks around them
+	edited := append(append(bytes.Clone(data[:1000]), []byte("inserted")...), data[1000:]...)
+	seen := make(map[string]bool)
+	for _, chunk := range chunks {
+		seen[string(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range cutChunks(t, newChunker(ChunkingCDC, avg, bytes.NewReader(edited))) {
+		if !seen[string(chunk)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("have %d of %d chunks changed, want at most 2", changed, len(chunks))
+	}
+}
+
+func TestStoreWithOpts(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	data := bytes.Repeat([]byte("content defined "), 100)
+	if err := s.StoreWithOpts(DefaultBucket, "cdc", bytes.NewReader(data), ObjectOpts{Chunking: ChunkingCDC}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.Get(DefaultBucket, "cdc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := io.ReadAll(r); !bytes.Equal(out, data) {
+		t.Errorf("have %d bytes want %d", len(out), len(data))
+	}
+
+	if err := s.StoreWithOpts(DefaultBucket, "bad", bytes.NewReader(data), ObjectOpts{Chunking: "zigzag"}); err == nil {
+		t.Error("expected an error for an unknown chunking")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A SealedClient encrypts objects before they reach the FileServer it stores
+// them through, with keys of its own the nodes never hold. Every node, the
+// one it talks to included, only ever sees the ciphertext, so nodes can run
+// on hardware that is not trusted with the data. The ciphertext is the
+// format of copyEncrypt, under a key derived from the client key and the
+// name of the object, so a node handing out the ciphertext of another object
+// under the name fails to decrypt.
+
+var ErrSharedKey = errors.New("client keys must not be known to the node")
+
+type SealedClient struct {
+	server *FileServer
+	keys   *Keystore
+}
+
+// NewSealedClient returns a client storing objects through s sealed with
+// keys, which must be kept apart from the keystore of any node.
+func NewSealedClient(s *FileServer, keys *Keystore) (*SealedClient, error) {
+	for _, id := range keys.IDs() {
+		if _, err := s.Keystore.Key(id); err == nil {
+			return nil, fmt.Errorf("%w: %s", ErrSharedKey, id)
+		}
+	}
+	return &SealedClient{server: s, keys: keys}, nil
+}
+
+// objectKeys returns the keys the object under key in bucket is sealed with.
+func (c *SealedClient) objectKeys(bucket, key string) *Keystore {
+	return c.keys.derive("dfs sealed object " + objectKey(bucket, key))
+}
+
+// Store encrypts r with the active client key and stores the ciphertext
+// under key.
+func (c *SealedClient) Store(bucket, key string, r io.Reader) error {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := copyEncrypt(c.objectKeys(bucket, key).Active(), r, pw)
+		pw.CloseWithError(err)
+	}()
+	err := c.server.Store(bucket, key, pr)
+	// stops the encryption if the server gave up before the end
+	pr.CloseWithError(err)
+	return err
+}
+
+// Get returns a reader decrypting the object under key as it is read, which
+// the caller closes.
+func (c *SealedClient) Get(bucket, key string) (io.ReadCloser, error) {
+	r, err := c.server.Get(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	dr, err := newDecryptReader(c.objectKeys(bucket, key), r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{dr, r}, nil
+}
+
+// GetRange returns length bytes of the object under key starting at offset,
+// fewer if the object ends before. Only the header and the segments holding
+// the range are read from the server.
+func (c *SealedClient) GetRange(bucket, key string, offset, length int64) (io.Reader, error) {
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("%w: %d bytes at %d", ErrInvalidRange, length, offset)
+	}
+	head, err := c.readRange(bucket, key, 0, int64(encHeaderSize))
+	if err != nil {
+		return nil, err
+	}
+	header, start, n, err := encryptedSection(head, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.readRange(bucket, key, start, n)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := decryptSection(c.objectKeys(bucket, key), append(bytes.Clone(header), data...), offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(plain), nil
+}
+
+func (c *SealedClient) readRange(bucket, key string, offset, length int64) ([]byte, error) {
+	r, err := c.server.GetRange(bucket, key, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// Delete deletes the object under key.
+func (c *SealedClient) Delete(bucket, key string) error {
+	return c.server.Delete(bucket, key)
+}
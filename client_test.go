@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSealedClient(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	s.ChunkSize = 32 << 10
+
+	if _, err := NewSealedClient(s, s.Keystore); !errors.Is(err, ErrSharedKey) {
+		t.Errorf("have %v want %v for the keys of the node", err, ErrSharedKey)
+	}
+	c, err := NewSealedClient(s, NewKeystore(newEncryptionKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("for the client's eyes only "), 5000)
+	if err := c.Store(DefaultBucket, "doc", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Get(DefaultBucket, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := io.ReadAll(r); err != nil || !bytes.Equal(out, data) {
+		t.Errorf("have %d bytes, %v want %d", len(out), err, len(data))
+	}
+	for _, rg := range [][2]int64{{0, 10}, {encSegmentSize - 5, 10}, {100000, 30000}, {int64(len(data)) - 3, 100}} {
+		r, err := c.GetRange(DefaultBucket, "doc", rg[0], rg[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, _ := io.ReadAll(r)
+		if want := data[rg[0]:min(rg[0]+rg[1], int64(len(data)))]; !bytes.Equal(out, want) {
+			t.Errorf("range %d+%d: have %d bytes want %d", rg[0], rg[1], len(out), len(want))
+		}
+	}
+
+	// the node holds nothing but ciphertext
+	filepath.WalkDir(s.store.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if b, _ := os.ReadFile(path); bytes.Contains(b, data[:27]) {
+			t.Errorf("plaintext in %s", path)
+		}
+		return nil
+	})
+
+	// a node serving another object under the name is caught
+	if err := c.Store(DefaultBucket, "other", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	r, _ = s.Get(DefaultBucket, "other")
+	if err := s.Store(DefaultBucket, "doc", r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(DefaultBucket, "doc"); !errors.Is(err, ErrCorruptCiphertext) {
+		t.Errorf("have %v want %v for swapped ciphertext", err, ErrCorruptCiphertext)
+	}
+}
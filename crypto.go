@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"fmt"
 	"io"
+	"math"
 )
 
 func generateID() string {
@@ -26,84 +33,696 @@ func newEncryptionKey() []byte {
 	return keyBuf
 }
 
-func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+// Data is encrypted in segments of at most encSegmentSize bytes, each sealed
+// with AES-GCM on its own, so that a stream is authenticated as it is read and
+// a range of it can be decrypted without the rest. The nonce of a segment is
+// the random prefix of the stream, the index of the segment and a flag set on
+// the last segment only, so segments cannot be reordered, dropped or cut off
+// without failing to open. The start of the header is authenticated along
+// with every segment.
+//
+// Every stream is encrypted with a random data key of its own, which the
+// header holds wrapped with AES-GCM under the master key it names. A master
+// key is never used on data, and moving a stream to another master key only
+// takes writing its header again: the segments do not authenticate the
+// wrapped key, which is bound to the rest of the header instead. Version 2
+// headers name the master key the segments are encrypted with, version 1
+// headers none. Convergent streams derive the data key and nonce prefix from
+// the data, see encryptConvergent. Streams encrypted before start with the IV
+// of AES-CTR instead of the header, they are still decrypted but not
+// authenticated.
+
+const (
+	encMagic       = "dfs\x00aead"
+	encVersion     = 3
+	encSegmentSize = 64 << 10
+	encPrefixSize  = 7
+	encKeyIDSize   = 8
+	encTagSize     = 16 // of AES-GCM
+
+	// encWrappedSize is a wrapped data key: the nonce, the key and the tag.
+	encWrappedSize = 12 + 32 + encTagSize
+
+	// the parts of a header, each following the one before
+	encCoreSize   = len(encMagic) + 1 + 4 + encPrefixSize
+	encKeyIDEnd   = encCoreSize + encKeyIDSize
+	encHeaderSize = encKeyIDEnd + encWrappedSize
+
+	// encMaxSegment bounds the segment size a header may announce.
+	encMaxSegment = 16 << 20
+)
+
+// ErrCorruptCiphertext reports encrypted data that fails to authenticate:
+// tampered with, truncated or encrypted with another key.
+var ErrCorruptCiphertext = fmt.Errorf("%w: encrypted data does not authenticate", ErrChecksumMismatch)
+
+// encHeader starts every stream encrypted in segments.
+type encHeader struct {
+	raw     []byte // as written
+	aad     []byte // the part of raw the segments authenticate
+	segment int    // bytes of plaintext per segment
+	prefix  []byte // of the nonces
+	keyID   string // of the master key, empty for version 1
+	wrapped []byte // data key, nil before version 3
+}
+
+// newEncHeader returns the header of a new stream encrypted with dataKey
+// and nonces starting with prefix, which holds dataKey wrapped under key.
+func newEncHeader(key MasterKey, prefix, dataKey []byte) (encHeader, error) {
+	raw := make([]byte, 0, encHeaderSize)
+	raw = append(raw, encMagic...)
+	raw = append(raw, encVersion)
+	raw = binary.BigEndian.AppendUint32(raw, encSegmentSize)
+	raw = append(raw, prefix...)
+
+	raw, err := wrapDataKey(raw, key, dataKey)
+	if err != nil {
+		return encHeader{}, err
+	}
+	return parseEncHeader(raw)
+}
+
+// wrapDataKey appends the ID of key and dataKey wrapped under it to core, the
+// start of a header. The wrapped key authenticates the rest of the header.
+// Its nonce is derived from the header and the data key, which never repeats
+// it for another data key, so that a header only depends on what it holds.
+func wrapDataKey(core []byte, key MasterKey, dataKey []byte) ([]byte, error) {
+	id, err := hex.DecodeString(key.ID)
+	if err != nil || len(id) != encKeyIDSize {
+		return nil, fmt.Errorf("invalid key ID %q", key.ID)
+	}
+	aead, err := newGCM(key.Key)
+	if err != nil {
+		return nil, err
+	}
+	raw := append(core[:encCoreSize:encCoreSize], id...)
+	mac := hmac.New(sha256.New, key.Key)
+	mac.Write(raw)
+	mac.Write(dataKey)
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+	raw = append(raw, nonce...)
+	return aead.Seal(raw, nonce, dataKey, raw[:encKeyIDEnd]), nil
+}
+
+// unwrapDataKey returns the data key of hdr, a version 3 header, with the
+// master key it names out of keys.
+func unwrapDataKey(keys *Keystore, hdr encHeader) ([]byte, error) {
+	key, err := keys.Key(hdr.keyID)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, sealed := hdr.wrapped[:aead.NonceSize()], hdr.wrapped[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, hdr.raw[:encKeyIDEnd])
+	if err != nil {
+		return nil, fmt.Errorf("%w: data key does not unwrap", ErrCorruptCiphertext)
+	}
+	return dataKey, nil
+}
+
+// rewrapHeader returns head, the header of a stream written by copyEncrypt,
+// with its data key wrapped under to instead. The segments following it stay
+// as they are. Headers from before data keys cannot be rewrapped, the streams
+// they start must be encrypted again.
+func rewrapHeader(keys *Keystore, head []byte, to MasterKey) ([]byte, error) {
+	hdr, err := parseEncHeader(head)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.wrapped == nil {
+		return nil, fmt.Errorf("version %d header holds no data key", hdr.raw[len(encMagic)])
+	}
+	dataKey, err := unwrapDataKey(keys, hdr)
+	if err != nil {
+		return nil, err
+	}
+	return wrapDataKey(bytes.Clone(hdr.raw), to, dataKey)
+}
+
+// isEncHeader tells the header of a stream encrypted in segments from the IV
+// of an older one. head holds at least the first aes.BlockSize bytes.
+func isEncHeader(head []byte) bool {
+	return string(head[:len(encMagic)]) == encMagic
+}
+
+// encHeaderLen returns the length of the header starting head, which holds
+// at least its first aes.BlockSize bytes.
+func encHeaderLen(head []byte) (int, error) {
+	switch v := head[len(encMagic)]; v {
+	case 1:
+		return encCoreSize, nil
+	case 2:
+		return encKeyIDEnd, nil
+	case encVersion:
+		return encHeaderSize, nil
+	default:
+		return 0, fmt.Errorf("unsupported encryption version %d", v)
+	}
+}
+
+// parseEncHeader parses the header starting b, a stream encrypted in
+// segments.
+func parseEncHeader(b []byte) (encHeader, error) {
+	if len(b) < aes.BlockSize || !isEncHeader(b) {
+		return encHeader{}, fmt.Errorf("%w: missing header", ErrCorruptCiphertext)
+	}
+	size, err := encHeaderLen(b)
+	if err != nil {
+		return encHeader{}, err
+	}
+	if len(b) < size {
+		return encHeader{}, fmt.Errorf("%w: header cut short", ErrCorruptCiphertext)
+	}
+	segment := binary.BigEndian.Uint32(b[len(encMagic)+1:])
+	if segment == 0 || segment > encMaxSegment {
+		return encHeader{}, fmt.Errorf("%w: segment size %d", ErrCorruptCiphertext, segment)
+	}
+
+	raw := b[:size:size]
+	hdr := encHeader{raw: raw, aad: raw, segment: int(segment)}
+	hdr.prefix = raw[encCoreSize-encPrefixSize : encCoreSize]
+	if size >= encKeyIDEnd {
+		hdr.keyID = hex.EncodeToString(raw[encCoreSize:encKeyIDEnd])
+	}
+	if size == encHeaderSize {
+		hdr.aad, hdr.wrapped = raw[:encCoreSize], raw[encKeyIDEnd:]
+	}
+	return hdr, nil
+}
+
+// segmentCipher seals and opens the segments of a stream.
+type segmentCipher struct {
+	aead cipher.AEAD
+	hdr  encHeader
+}
+
+// openSegmentCipher returns the cipher of the stream hdr starts, with its
+// data key, or the master key it names out of keys before data keys.
+func openSegmentCipher(keys *Keystore, hdr encHeader) (*segmentCipher, error) {
+	var (
+		key []byte
+		err error
+	)
+	if hdr.wrapped != nil {
+		key, err = unwrapDataKey(keys, hdr)
+	} else {
+		key, err = keys.Key(hdr.keyID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newSegmentCipher(key, hdr)
+}
+
+func newSegmentCipher(key []byte, hdr encHeader) (*segmentCipher, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentCipher{aead: aead, hdr: hdr}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealedSize is the size of a full segment once sealed.
+func (c *segmentCipher) sealedSize() int {
+	return c.hdr.segment + c.aead.Overhead()
+}
+
+func (c *segmentCipher) nonce(i uint64, last bool) ([]byte, error) {
+	if i > math.MaxUint32 {
+		return nil, fmt.Errorf("stream exceeds %d segments", uint64(math.MaxUint32)+1)
+	}
+	nonce := make([]byte, 0, c.aead.NonceSize())
+	nonce = append(nonce, c.hdr.prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, uint32(i))
+	if last {
+		return append(nonce, 1), nil
 	}
+	return append(nonce, 0), nil
+}
 
-	iv := make([]byte, block.BlockSize())
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+func (c *segmentCipher) seal(dst, plain []byte, i uint64, last bool) ([]byte, error) {
+	nonce, err := c.nonce(i, last)
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(dst, nonce, plain, c.hdr.aad), nil
+}
+
+func (c *segmentCipher) open(dst, sealed []byte, i uint64, last bool) ([]byte, error) {
+	nonce, err := c.nonce(i, last)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := c.aead.Open(dst, nonce, sealed, c.hdr.aad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: segment %d", ErrCorruptCiphertext, i)
+	}
+	return plain, nil
+}
+
+// copyEncrypt encrypts src into dst in segments under a new data key, which
+// it wraps under key, and returns the bytes written.
+func copyEncrypt(key MasterKey, src io.Reader, dst io.Writer) (int, error) {
+	prefix := make([]byte, encPrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
 		return 0, err
 	}
+	return encryptStream(key, prefix, newEncryptionKey(), src, dst)
+}
+
+// encryptConvergent encrypts data into dst like copyEncrypt, with a data key
+// and nonce prefix derived from data and key instead of random ones, and
+// returns the bytes written. The same data encrypts the same under the same
+// master key, which reveals that two streams hold the same data to anyone
+// comparing them.
+func encryptConvergent(key MasterKey, data []byte, dst io.Writer) (int, error) {
+	mac := hmac.New(sha256.New, key.Key)
+	mac.Write([]byte("dfs convergent data key"))
+	mac.Write(data)
+	dataKey := mac.Sum(nil)
 
-	// prepend the IV to the file
-	if _, err := dst.Write(iv); err != nil {
+	mac = hmac.New(sha256.New, dataKey)
+	mac.Write([]byte("dfs convergent nonce prefix"))
+	prefix := mac.Sum(nil)[:encPrefixSize]
+	return encryptStream(key, prefix, dataKey, bytes.NewReader(data), dst)
+}
+
+// encryptStream encrypts src into dst in segments under dataKey, which it
+// wraps under key, and returns the bytes written.
+func encryptStream(key MasterKey, prefix, dataKey []byte, src io.Reader, dst io.Writer) (int, error) {
+	hdr, err := newEncHeader(key, prefix, dataKey)
+	if err != nil {
+		return 0, err
+	}
+	c, err := newSegmentCipher(dataKey, hdr)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := dst.Write(hdr.raw); err != nil {
 		return 0, err
 	}
 
 	var (
-		buf    = make([]byte, 32*1024)
-		stream = cipher.NewCTR(block, iv)
-		nw     = block.BlockSize()
+		r      = bufio.NewReaderSize(src, hdr.segment)
+		buf    = make([]byte, hdr.segment)
+		sealed = make([]byte, 0, c.sealedSize())
+		nw     = len(hdr.raw)
 	)
-
-	for {
-		n, err := src.Read(buf)
-		if n > 0 {
-			stream.XORKeyStream(buf, buf[:n])
-			var lnw int
-			if lnw, err = dst.Write(buf[:n]); err != nil {
+	for i := uint64(0); ; i++ {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		// a full segment is the last one only if nothing follows it
+		last := err != nil
+		if !last {
+			if _, err := r.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
 				return 0, err
 			}
-			nw += lnw
 		}
 
-		if err == io.EOF {
-			break
+		if sealed, err = c.seal(sealed[:0], buf[:n], i, last); err != nil {
+			return 0, err
+		}
+		lnw, err := dst.Write(sealed)
+		if err != nil {
+			return 0, err
+		}
+		nw += lnw
+		if last {
+			return nw, nil
+		}
+	}
+}
+
+// rekey copies src, a stream written by copyEncrypt, to dst under the master
+// key to. A stream with a data key only gets its header rewrapped, older
+// streams are decrypted and encrypted again.
+func rekey(keys *Keystore, to MasterKey, src io.Reader, dst io.Writer) error {
+	r := bufio.NewReader(src)
+	head, err := r.Peek(encHeaderSize)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if len(head) > len(encMagic) && isEncHeader(head) && head[len(encMagic)] == encVersion {
+		if head, err = rewrapHeader(keys, head, to); err != nil {
+			return err
 		}
+		if _, err := r.Discard(len(head)); err != nil {
+			return err
+		}
+		if _, err := dst.Write(head); err != nil {
+			return err
+		}
+		_, err := io.Copy(dst, r)
+		return err
+	}
+
+	dr, err := newDecryptReader(keys, r)
+	if err != nil {
+		return err
+	}
+	_, err = copyEncrypt(to, dr, dst)
+	return err
+}
 
+// newDecryptReader returns a reader decrypting src, a stream written by
+// copyEncrypt, as it is read. Reading fails with ErrCorruptCiphertext once it
+// gets to a segment that does not authenticate, or to the end of a stream cut
+// short.
+func newDecryptReader(keys *Keystore, src io.Reader) (io.Reader, error) {
+	head := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(src, head); err != nil {
+		return nil, err
+	}
+	if !isEncHeader(head) {
+		stream, err := legacyStream(keys, head)
 		if err != nil {
+			return nil, err
+		}
+		return cipher.StreamReader{S: stream, R: src}, nil
+	}
+
+	size, err := encHeaderLen(head)
+	if err != nil {
+		return nil, err
+	}
+	head = append(head, make([]byte, size-aes.BlockSize)...)
+	if _, err := io.ReadFull(src, head[aes.BlockSize:]); err != nil {
+		return nil, err
+	}
+	hdr, err := parseEncHeader(head)
+	if err != nil {
+		return nil, err
+	}
+	c, err := openSegmentCipher(keys, hdr)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentReader{
+		c:      c,
+		r:      bufio.NewReaderSize(src, c.sealedSize()),
+		sealed: make([]byte, c.sealedSize()),
+		plain:  make([]byte, 0, hdr.segment),
+	}, nil
+}
+
+// segmentReader opens the segments of a stream one after the other.
+type segmentReader struct {
+	c      *segmentCipher
+	r      *bufio.Reader
+	sealed []byte
+	plain  []byte
+	out    []byte // opened but not read yet
+	i      uint64
+	done   bool
+}
+
+func (r *segmentReader) Read(b []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
 			return 0, err
 		}
+	}
+	n := copy(b, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *segmentReader) next() error {
+	n, err := io.ReadFull(r.r, r.sealed)
+	last := err == io.ErrUnexpectedEOF
+	switch {
+	case err == io.EOF:
+		return fmt.Errorf("%w: stream ends before its last segment", ErrCorruptCiphertext)
+	case err != nil && !last:
+		return err
+	case !last:
+		if _, err := r.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
 
+	plain, err := r.c.open(r.plain[:0], r.sealed[:n], r.i, last)
+	if err != nil {
+		return err
 	}
-	return nw, nil
+	r.out = plain
+	r.i++
+	r.done = last
+	return nil
 }
 
-func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+// legacyStream returns the AES-CTR stream of data encrypted before segments
+// with iv, which is taken to use the oldest key of keys.
+func legacyStream(keys *Keystore, iv []byte) (cipher.Stream, error) {
+	key, err := keys.Key("")
+	if err != nil {
+		return nil, err
+	}
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	return cipher.NewCTR(block, iv), nil
+}
+
+// decryptWriter decrypts what is written to it, starting with the header or
+// the IV, into w. Close must be called once the whole stream is written, it
+// opens the last segment.
+type decryptWriter struct {
+	keys *Keystore
+	w    io.Writer
+
+	head   []byte
+	sw     io.Writer // of a stream encrypted before segments
+	c      *segmentCipher
+	sealed []byte // not opened yet
+	plain  []byte
+	i      uint64
+}
+
+func (d *decryptWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for d.sw == nil && d.c == nil {
+		// the IV of an older stream is as long as the start of the header
+		size := aes.BlockSize
+		if len(d.head) >= aes.BlockSize && isEncHeader(d.head) {
+			var err error
+			if size, err = encHeaderLen(d.head); err != nil {
+				return 0, err
+			}
+		}
+		take := min(size-len(d.head), len(b))
+		d.head = append(d.head, b[:take]...)
+		b = b[take:]
+		if len(d.head) < size {
+			return n, nil
+		}
+		if size > aes.BlockSize || !isEncHeader(d.head) {
+			if err := d.init(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if d.sw != nil {
+		if _, err := d.sw.Write(b); err != nil {
+			return 0, err
+		}
+		return n, nil
 	}
 
-	iv := make([]byte, block.BlockSize())
-	if _, err := src.Read(iv); err != nil {
+	// a full segment is only opened once more follows, the last one on Close
+	d.sealed = append(d.sealed, b...)
+	size := d.c.sealedSize()
+	for len(d.sealed) > size {
+		if err := d.openNext(d.sealed[:size], false); err != nil {
+			return 0, err
+		}
+		d.sealed = d.sealed[:copy(d.sealed, d.sealed[size:])]
+	}
+	return n, nil
+}
+
+func (d *decryptWriter) init() error {
+	if !isEncHeader(d.head) {
+		stream, err := legacyStream(d.keys, d.head)
+		if err != nil {
+			return err
+		}
+		d.sw = cipher.StreamWriter{S: stream, W: d.w}
+		return nil
+	}
+	hdr, err := parseEncHeader(d.head)
+	if err != nil {
+		return err
+	}
+	d.c, err = openSegmentCipher(d.keys, hdr)
+	return err
+}
+
+// keyID returns the ID of the key the stream written so far is encrypted
+// with. Streams that do not name one are read with the oldest key.
+func (d *decryptWriter) keyID() string {
+	if d.c != nil && d.c.hdr.keyID != "" {
+		return d.c.hdr.keyID
+	}
+	return d.keys.IDs()[0]
+}
+
+func (d *decryptWriter) openNext(sealed []byte, last bool) error {
+	plain, err := d.c.open(d.plain[:0], sealed, d.i, last)
+	if err != nil {
+		return err
+	}
+	d.plain = plain
+	d.i++
+	_, err = d.w.Write(plain)
+	return err
+}
+
+// Close opens the last segment. It fails if the stream was cut short.
+func (d *decryptWriter) Close() error {
+	if d.sw != nil {
+		return nil
+	}
+	if d.c == nil {
+		return fmt.Errorf("%w: stream ends in its header", ErrCorruptCiphertext)
+	}
+	return d.openNext(d.sealed, true)
+}
+
+// copyDecrypt decrypts src, a stream written by copyEncrypt, into dst and
+// returns the bytes written.
+func copyDecrypt(keys *Keystore, src io.Reader, dst io.Writer) (int, error) {
+	r, err := newDecryptReader(keys, src)
+	if err != nil {
 		return 0, err
 	}
+	n, err := io.Copy(dst, r)
+	return int(n), err
+}
+
+// encryptedSection returns where to find the plaintext range of length bytes
+// from offset in a stream written by copyEncrypt, given head, the first
+// encHeaderSize bytes of the stream or all of it if shorter, which is at
+// least as long as any header. The range takes the header, which is
+// returned, and n bytes of the stream from start.
+func encryptedSection(head []byte, offset, length int64) (header []byte, start, n int64, err error) {
+	if len(head) < aes.BlockSize {
+		return nil, 0, 0, io.ErrUnexpectedEOF
+	}
+	if !isEncHeader(head) {
+		return head[:aes.BlockSize], aes.BlockSize + offset, length, nil
+	}
+	hdr, err := parseEncHeader(head)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if length == 0 {
+		return hdr.raw, int64(len(hdr.raw)), 0, nil
+	}
+	segment, sealed := int64(hdr.segment), int64(hdr.segment+encTagSize)
+	first, last := offset/segment, (offset+length-1)/segment
+	return hdr.raw, int64(len(hdr.raw)) + first*sealed, (last - first + 1) * sealed, nil
+}
+
+// decryptSection decrypts length bytes from offset out of raw, the header
+// followed by the part of the stream encryptedSection located. It returns
+// fewer bytes if the stream ends before.
+func decryptSection(keys *Keystore, raw []byte, offset, length int64) ([]byte, error) {
+	if len(raw) < aes.BlockSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if !isEncHeader(raw) {
+		key, err := keys.Key("")
+		if err != nil {
+			return nil, err
+		}
+		return decryptAt(key, raw[:aes.BlockSize], offset, raw[aes.BlockSize:])
+	}
+	hdr, err := parseEncHeader(raw)
+	if err != nil {
+		return nil, err
+	}
+	c, err := openSegmentCipher(keys, hdr)
+	if err != nil {
+		return nil, err
+	}
 
 	var (
-		buf    = make([]byte, 32*1024)
-		stream = cipher.NewCTR(block, iv)
-		nw     = block.BlockSize()
+		segment = int64(hdr.segment)
+		i       = uint64(offset / segment)
+		data    = raw[len(hdr.raw):]
+		out     []byte
 	)
+	for len(data) > 0 {
+		sealed := data[:min(len(data), c.sealedSize())]
+		data = data[len(sealed):]
 
-	for {
-		n, err := src.Read(buf)
-		if n > 0 {
-			stream.XORKeyStream(buf, buf[:n])
-			var lnw int
-			if lnw, err = dst.Write(buf[:n]); err != nil {
-				return 0, nil
-			}
-			nw += lnw
-		}
-		if err == io.EOF {
-			break
+		// whether a full segment ending the section ends the stream too is
+		// not known, it only opens as one or the other
+		last := len(sealed) < c.sealedSize()
+		plain, err := c.open(out, sealed, i, last)
+		if err != nil && len(data) == 0 && !last {
+			plain, err = c.open(out, sealed, i, true)
 		}
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
+		out = plain
+		i++
+	}
+
+	skip := min(offset%segment, int64(len(out)))
+	return out[skip:min(skip+length, int64(len(out)))], nil
+}
+
+// decryptAt decrypts data, which starts offset bytes into a stream encrypted
+// with AES-CTR and iv before segments. The CTR counter is advanced by the
+// blocks before offset and the key stream of the partial block is skipped, so
+// a slice can be decrypted without the bytes before it.
+func decryptAt(key, iv []byte, offset int64, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	// the counter is the IV as a big endian number
+	ctr := append([]byte(nil), iv...)
+	n := uint64(offset / int64(block.BlockSize()))
+	for i := len(ctr) - 1; i >= 0 && n > 0; i-- {
+		sum := uint64(ctr[i]) + n&0xff
+		ctr[i] = byte(sum)
+		n = n>>8 + sum>>8
 	}
-	return nw, nil
+
+	stream := cipher.NewCTR(block, ctr)
+	skip := make([]byte, offset%int64(block.BlockSize()))
+	stream.XORKeyStream(skip, skip)
+
+	out := make([]byte, len(data))
+	stream.XORKeyStream(out, data)
+	return out, nil
 }
@@ -2,16 +2,22 @@ package main
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
 	"testing"
 )
 
 func TestCopyCrypto(t *testing.T) {
 	payload := "Vasanth Kumar"
-	key := newEncryptionKey()
+	keys := NewKeystore(newEncryptionKey())
 	src := bytes.NewReader([]byte(payload))
 	dst := new(bytes.Buffer)
 
-	_, err := copyEncrypt(key, src, dst)
+	_, err := copyEncrypt(keys.Active(), src, dst)
 	if err != nil {
 		t.Error(err)
 	}
@@ -19,7 +25,7 @@ func TestCopyCrypto(t *testing.T) {
 	// t.Log(dst.Bytes())
 
 	out := new(bytes.Buffer)
-	if _, err := copyDecrypt(key, dst, out); err != nil {
+	if _, err := copyDecrypt(keys, dst, out); err != nil {
 		t.Error(err)
 	}
 
@@ -30,3 +36,247 @@ func TestCopyCrypto(t *testing.T) {
 	}
 
 }
+
+func TestCopyCryptoSegments(t *testing.T) {
+	keys := NewKeystore(newEncryptionKey())
+	for _, size := range []int{0, 1, encSegmentSize, encSegmentSize + 1, 3*encSegmentSize - 7} {
+		payload := bytes.Repeat([]byte{'x'}, size)
+		enc := new(bytes.Buffer)
+		if _, err := copyEncrypt(keys.Active(), bytes.NewReader(payload), enc); err != nil {
+			t.Fatal(err)
+		}
+		wire := enc.Bytes()
+
+		out := new(bytes.Buffer)
+		if _, err := copyDecrypt(keys, bytes.NewReader(wire), out); err != nil || !bytes.Equal(out.Bytes(), payload) {
+			t.Errorf("%d bytes: have %d bytes, %v", size, out.Len(), err)
+		}
+		dw := &decryptWriter{keys: keys, w: new(bytes.Buffer)}
+		for b := wire; len(b) > 0; b = b[min(len(b), 1000):] {
+			dw.Write(b[:min(len(b), 1000)])
+		}
+		if err := dw.Close(); err != nil || !bytes.Equal(dw.w.(*bytes.Buffer).Bytes(), payload) {
+			t.Errorf("%d bytes written: %v", size, err)
+		}
+
+		// the last segment ends the stream, so cutting it off is noticed
+		segments := max(1, (size+encSegmentSize-1)/encSegmentSize)
+		cut := wire[:len(wire)-encTagSize-(size-(segments-1)*encSegmentSize)]
+		if _, err := copyDecrypt(keys, bytes.NewReader(cut), io.Discard); !errors.Is(err, ErrCorruptCiphertext) {
+			t.Errorf("%d bytes cut to %d: have %v want %v", size, len(cut), err, ErrCorruptCiphertext)
+		}
+	}
+}
+
+func TestCopyCryptoTampered(t *testing.T) {
+	keys := NewKeystore(newEncryptionKey())
+	payload := bytes.Repeat([]byte("0123456789abcdef-"), 5000)
+	enc := new(bytes.Buffer)
+	if _, err := copyEncrypt(keys.Active(), bytes.NewReader(payload), enc); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, at := range []int{encCoreSize - 1, encHeaderSize - 1, encHeaderSize + 10, enc.Len() - 1} {
+		wire := bytes.Clone(enc.Bytes())
+		wire[at] ^= 1
+		if _, err := copyDecrypt(keys, bytes.NewReader(wire), io.Discard); !errors.Is(err, ErrCorruptCiphertext) {
+			t.Errorf("byte %d flipped: have %v want %v", at, err, ErrCorruptCiphertext)
+		}
+	}
+	if _, err := copyDecrypt(NewKeystore(newEncryptionKey()), bytes.NewReader(enc.Bytes()), io.Discard); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("have %v want %v for another keystore", err, ErrUnknownKey)
+	}
+
+	// a key with another ID does not open the stream either
+	other := NewKeystore(newEncryptionKey())
+	other.keys[keys.Active().ID] = other.keys[other.Active().ID]
+	if _, err := copyDecrypt(other, bytes.NewReader(enc.Bytes()), io.Discard); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("have %v want %v for the wrong key", err, ErrChecksumMismatch)
+	}
+}
+
+func TestRewrapHeader(t *testing.T) {
+	keys := NewKeystore(newEncryptionKey())
+	old := keys.Active()
+	payload := bytes.Repeat([]byte("0123456789abcdef-"), 5000)
+	enc := new(bytes.Buffer)
+	if _, err := copyEncrypt(old, bytes.NewReader(payload), enc); err != nil {
+		t.Fatal(err)
+	}
+	wire := enc.Bytes()
+
+	rotated := NewKeystore(newEncryptionKey())
+	head, err := rewrapHeader(keys, wire[:encHeaderSize], rotated.Active())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(head) != encHeaderSize || !bytes.Equal(head[:encCoreSize], wire[:encCoreSize]) {
+		t.Fatalf("have header %x want the start of %x", head, wire[:encHeaderSize])
+	}
+
+	// the segments open with the data key under the new master key alone
+	out := new(bytes.Buffer)
+	rewrapped := append(head, wire[encHeaderSize:]...)
+	if _, err := copyDecrypt(rotated, bytes.NewReader(rewrapped), out); err != nil || !bytes.Equal(out.Bytes(), payload) {
+		t.Errorf("have %d bytes, %v", out.Len(), err)
+	}
+	if _, err := copyDecrypt(keys, bytes.NewReader(rewrapped), io.Discard); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("have %v want %v for the old key", err, ErrUnknownKey)
+	}
+
+	// a wrapped key does not open another stream
+	other := new(bytes.Buffer)
+	if _, err := copyEncrypt(old, bytes.NewReader(payload), other); err != nil {
+		t.Fatal(err)
+	}
+	swapped := append(bytes.Clone(other.Bytes()[:encKeyIDEnd]), wire[encKeyIDEnd:]...)
+	if _, err := copyDecrypt(keys, bytes.NewReader(swapped), io.Discard); !errors.Is(err, ErrCorruptCiphertext) {
+		t.Errorf("have %v want %v for a swapped data key", err, ErrCorruptCiphertext)
+	}
+}
+
+func TestEncryptConvergent(t *testing.T) {
+	key := NewKeystore(newEncryptionKey()).Active()
+	payload := bytes.Repeat([]byte("same content "), 10000)
+
+	var wires [][]byte
+	for _, data := range [][]byte{payload, bytes.Clone(payload), append(bytes.Clone(payload), '!')} {
+		enc := new(bytes.Buffer)
+		if _, err := encryptConvergent(key, data, enc); err != nil {
+			t.Fatal(err)
+		}
+		wires = append(wires, enc.Bytes())
+	}
+	if !bytes.Equal(wires[0], wires[1]) {
+		t.Error("expected the same content to encrypt the same")
+	}
+	if bytes.Equal(wires[0][encHeaderSize:encHeaderSize+100], wires[2][encHeaderSize:encHeaderSize+100]) {
+		t.Error("expected other content to encrypt differently")
+	}
+
+	other := new(bytes.Buffer)
+	if _, err := encryptConvergent(NewKeystore(newEncryptionKey()).Active(), payload, other); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(other.Bytes()[encHeaderSize:], wires[0][encHeaderSize:]) {
+		t.Error("expected another master key to encrypt differently")
+	}
+
+	out := new(bytes.Buffer)
+	keys := NewKeystore(key.Key)
+	if _, err := copyDecrypt(keys, bytes.NewReader(wires[0]), out); err != nil || !bytes.Equal(out.Bytes(), payload) {
+		t.Errorf("have %d bytes, %v", out.Len(), err)
+	}
+}
+
+// encryptV2 encrypts like copyEncrypt did before data keys, with the master
+// key itself.
+func encryptV2(t *testing.T, key MasterKey, payload []byte) []byte {
+	id, _ := hex.DecodeString(key.ID)
+	raw := append([]byte(encMagic), 2)
+	raw = binary.BigEndian.AppendUint32(raw, encSegmentSize)
+	raw = append(raw, bytes.Repeat([]byte{7}, encPrefixSize)...)
+	hdr, err := parseEncHeader(append(raw, id...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newSegmentCipher(key.Key, hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := c.seal(nil, payload, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(bytes.Clone(hdr.raw), sealed...)
+}
+
+// encryptCTR encrypts like copyEncrypt did before segments.
+func encryptCTR(t *testing.T, key, payload []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := bytes.Repeat([]byte{7}, aes.BlockSize)
+	out := make([]byte, len(payload))
+	cipher.NewCTR(block, iv).XORKeyStream(out, payload)
+	return append(iv, out...)
+}
+
+func TestDecryptLegacy(t *testing.T) {
+	key := newEncryptionKey()
+	keys := NewKeystore(key)
+	payload := []byte("encrypted before streams were authenticated")
+
+	for _, wire := range [][]byte{encryptCTR(t, key, payload), encryptV2(t, keys.Active(), payload)} {
+		out := new(bytes.Buffer)
+		if _, err := copyDecrypt(keys, &oneByteReader{b: wire}, out); err != nil || !bytes.Equal(out.Bytes(), payload) {
+			t.Errorf("have %q %v want %q", out, err, payload)
+		}
+		dw := &decryptWriter{keys: keys, w: new(bytes.Buffer)}
+		dw.Write(wire[:5])
+		dw.Write(wire[5:])
+		if err := dw.Close(); err != nil || !bytes.Equal(dw.w.(*bytes.Buffer).Bytes(), payload) {
+			t.Errorf("have %q %v want %q", dw.w, err, payload)
+		}
+	}
+}
+
+// oneByteReader reads a byte at a time, so that reads of the IV come up short.
+type oneByteReader struct{ b []byte }
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(len(p), 1)], r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+func TestDecryptAt(t *testing.T) {
+	key := newEncryptionKey()
+	payload := bytes.Repeat([]byte("0123456789abcdef-"), 100)
+
+	enc := encryptCTR(t, key, payload)
+	iv, ciphertext := enc[:16], enc[16:]
+
+	for _, r := range [][2]int{{0, 10}, {5, 30}, {16, 16}, {17, 100}, {1000, 700}} {
+		off, n := r[0], r[1]
+		have, err := decryptAt(key, iv, int64(off), ciphertext[off:off+n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(have, payload[off:off+n]) {
+			t.Errorf("range %d+%d: have %q want %q", off, n, have, payload[off:off+n])
+		}
+	}
+}
+
+func TestDecryptSection(t *testing.T) {
+	key := newEncryptionKey()
+	keys := NewKeystore(key)
+	payload := bytes.Repeat([]byte("0123456789abcdef-"), 9000)
+
+	for _, wire := range [][]byte{nil, encryptCTR(t, key, payload)} {
+		if wire == nil {
+			enc := new(bytes.Buffer)
+			if _, err := copyEncrypt(keys.Active(), bytes.NewReader(payload), enc); err != nil {
+				t.Fatal(err)
+			}
+			wire = enc.Bytes()
+		}
+		for _, r := range [][2]int{{0, 10}, {5, encSegmentSize}, {encSegmentSize, 1}, {100000, 53000}, {len(payload) - 3, 3}} {
+			off, n := int64(r[0]), int64(r[1])
+			header, start, size, err := encryptedSection(wire[:encHeaderSize], off, n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw := append(bytes.Clone(header), wire[start:min(start+size, int64(len(wire)))]...)
+			have, err := decryptSection(keys, raw, off, n)
+			if err != nil || !bytes.Equal(have, payload[off:off+n]) {
+				t.Errorf("range %d+%d: have %d bytes, %v", off, n, len(have), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dirMagic starts every directory node, so a directory is never mistaken for
+// a file that happens to hold JSON.
+const dirMagic = "dfs-dir/1\n"
+
+var ErrNotDir = errors.New("blob is not a directory")
+
+// DirLink names a child of a directory by the blob ID of its content. The ID
+// of a subdirectory is the ID of its own DirNode.
+type DirLink struct {
+	Name string
+	CID  string
+	Size int64
+	Dir  bool
+}
+
+// DirNode is stored as a blob and lists the children of a directory sorted by
+// name. Its blob ID covers the IDs of all children, so the ID of the top
+// directory identifies the whole tree.
+type DirNode struct {
+	Links []DirLink
+}
+
+func encodeDirNode(n DirNode) ([]byte, error) {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(dirMagic), b...), nil
+}
+
+func decodeDirNode(r io.Reader) (DirNode, error) {
+	var n DirNode
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(dirMagic))
+	if (err != nil && err != io.EOF) || string(magic) != dirMagic {
+		return n, ErrNotDir
+	}
+	br.Discard(len(dirMagic))
+	if err := json.NewDecoder(br).Decode(&n); err != nil {
+		return n, fmt.Errorf("corrupt directory node: %w", err)
+	}
+	return n, nil
+}
+
+// validLinkName keeps the names of a directory node from escaping the
+// directory it is written to.
+func validLinkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid directory entry [%s]", name)
+	}
+	return nil
+}
+
+// AddDir stores every regular file below path as a blob and every directory
+// as a DirNode, and returns the ID of the top directory. Adding the same tree
+// twice returns the same ID. Entries other than files and directories, such
+// as symlinks, are skipped.
+func (s *FileServer) AddDir(path string) (string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return "", err
+	}
+
+	var node DirNode
+	for _, entry := range entries {
+		child := filepath.Join(path, entry.Name())
+		link := DirLink{Name: entry.Name(), Dir: entry.IsDir()}
+
+		switch {
+		case entry.IsDir():
+			link.CID, err = s.AddDir(child)
+		case entry.Type().IsRegular():
+			link.CID, link.Size, err = s.addFile(child)
+		default:
+			log.Printf("[%s] skipping [%s], not a regular file\n", s.Transport.ListenAddr(), child)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		node.Links = append(node.Links, link)
+	}
+
+	b, err := encodeDirNode(node)
+	if err != nil {
+		return "", err
+	}
+	return s.PutBlob(bytes.NewReader(b))
+}
+
+func (s *FileServer) addFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	cid, err := s.PutBlob(f)
+	return cid, info.Size(), err
+}
+
+// GetDir recreates the tree of the directory root below dest, fetching the
+// blobs from the network as needed.
+func (s *FileServer) GetDir(root, dest string) error {
+	node, err := s.getDirNode(root)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, os.ModePerm); err != nil {
+		return err
+	}
+
+	for _, link := range node.Links {
+		if err := validLinkName(link.Name); err != nil {
+			return err
+		}
+		child := filepath.Join(dest, link.Name)
+		if link.Dir {
+			err = s.GetDir(link.CID, child)
+		} else {
+			err = s.getFile(link.CID, child)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileServer) getDirNode(cid string) (DirNode, error) {
+	r, err := s.GetBlob(cid)
+	if err != nil {
+		return DirNode{}, err
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return DirNode{}, err
+	}
+	node, err := decodeDirNode(bytes.NewReader(b))
+	if err != nil {
+		return node, fmt.Errorf("%s: %w", cid, err)
+	}
+	return node, nil
+}
+
+func (s *FileServer) getFile(cid, path string) error {
+	r, err := s.GetBlob(cid)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirRoundTrip(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	src := t.TempDir()
+	files := map[string]string{
+		"a.txt":           "first file",
+		"bin/tool":        "a build artifact spanning chunks",
+		"bin/lib/empty":   "",
+		"docs/readme.txt": "first file",
+	}
+	for name, content := range files {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root, err := s.AddDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := s.AddDir(src); err != nil || again != root {
+		t.Errorf("have root %s err %v want %s", again, err, root)
+	}
+
+	dest := filepath.Join(t.TempDir(), "out")
+	if err := s.GetDir(root, dest); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		b, err := os.ReadFile(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != content {
+			t.Errorf("%s: have %q want %q", name, b, content)
+		}
+	}
+
+	// a file is not a directory
+	node, _ := s.getDirNode(root)
+	if err := s.GetDir(node.Links[0].CID, t.TempDir()); err == nil {
+		t.Error("expected an error getting a file as a directory")
+	}
+}
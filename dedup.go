@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/vasanthgk02/distributed_file_system/p2p"
+)
+
+// Chunks are stored under their content, so identical chunks of different
+// objects share one copy per node. Every copy records the objects referencing
+// it and is deleted once the last of them is released. References are a set,
+// not a counter, so taking or releasing one twice, or from two nodes, is
+// harmless.
+
+// MessageHasKeys asks a peer which of Keys it holds. The peer replies with
+// one byte per key, 1 if it holds the key.
+type MessageHasKeys struct {
+	Keys []string
+}
+
+// MessageChunkRefs adds Object to the references of the chunks and shards
+// under Keys, or removes it if Release is set, on every copy the peer holds.
+// Keys the peer does not hold are ignored.
+type MessageChunkRefs struct {
+	Object  string
+	Keys    []string
+	Release bool
+}
+
+// DedupStats compares the bytes the chunks held by a node stand for with the
+// bytes they take on disk.
+type DedupStats struct {
+	Chunks   int   // chunks and shards on disk
+	Refs     int   // references to them
+	Logical  int64 // bytes of all references
+	Physical int64 // bytes on disk
+}
+
+// Ratio is how many bytes are referenced per byte on disk, 1 without any
+// sharing.
+func (d DedupStats) Ratio() float64 {
+	if d.Physical == 0 {
+		return 1
+	}
+	return float64(d.Logical) / float64(d.Physical)
+}
+
+// manifestKeys returns the keys of the chunks, or of the shards for erasure
+// coded objects, that an object stored with m references.
+func manifestKeys(m Manifest) []string {
+	keys := make([]string, 0, len(m.Chunks))
+	for _, ref := range m.Chunks {
+		if !m.ErasureCoded() {
+			keys = append(keys, m.chunkKey(ref.ID))
+			continue
+		}
+		for i := range m.DataShards + m.ParityShards {
+			keys = append(keys, m.shardKey(ref.ID, i))
+		}
+	}
+	return keys
+}
+
+// lacking asks peers for key and returns the peers that do not hold it, so
+// that a chunk is only sent where it is missing.
+func (s *FileServer) lacking(peers []p2p.Peer, key string) []p2p.Peer {
+	if len(peers) == 0 {
+		return nil
+	}
+
+	msg := Message{
+		Payload: MessageHasKeys{Keys: []string{hashKey(key)}},
+	}
+	held := make(map[p2p.Peer]bool)
+	err := s.collectFrom(peers, &msg, func(peer p2p.Peer) error {
+		has := make([]byte, 1)
+		if _, err := io.ReadFull(peer, has); err != nil {
+			return err
+		}
+		held[peer] = has[0] == 1
+		return nil
+	})
+	if err != nil {
+		return peers
+	}
+
+	missing := make([]p2p.Peer, 0, len(peers))
+	for _, peer := range peers {
+		if !held[peer] {
+			missing = append(missing, peer)
+		}
+	}
+	return missing
+}
+
+// retain makes object a reference of the chunks of m, on this node and on
+// every peer holding one of them.
+func (s *FileServer) retain(object string, m Manifest) error {
+	return s.updateRefs(object, manifestKeys(m), false)
+}
+
+// release drops object from the references of the chunks of m, chunks left
+// without references are deleted.
+func (s *FileServer) release(object string, m Manifest) error {
+	return s.updateRefs(object, manifestKeys(m), true)
+}
+
+func (s *FileServer) updateRefs(object string, keys []string, release bool) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	for _, key := range keys {
+		if err := s.refCopies(key, object, !release); err != nil {
+			log.Printf("[%s] unable to update references of [%s]: %s\n", s.Transport.ListenAddr(), key, err)
+		}
+	}
+
+	msg := Message{
+		Payload: MessageChunkRefs{
+			Object:  object,
+			Keys:    keys,
+			Release: release,
+		},
+	}
+	return s.broadCast(&msg)
+}
+
+// releaseStale releases the chunks of old that the new manifest of object no
+// longer references.
+func (s *FileServer) releaseStale(object string, old, cur Manifest) error {
+	keep := make(map[string]bool)
+	for _, key := range manifestKeys(cur) {
+		keep[key] = true
+	}
+
+	var stale []string
+	for _, key := range manifestKeys(old) {
+		if !keep[key] {
+			stale = append(stale, key)
+		}
+	}
+	return s.updateRefs(object, stale, true)
+}
+
+// localManifest returns the manifest of key if this node holds it.
+func (s *FileServer) localManifest(key string) (Manifest, bool) {
+	_, r, err := s.store.readStream(key)
+	if err != nil {
+		return Manifest{}, false
+	}
+	defer r.Close()
+
+	m, ok, _, err := readManifest(r)
+	return m, ok && err == nil
+}
+
+// refCopies updates the references of both copies of key a node may hold,
+// the chunk it stored itself and the replica it received from a peer.
+func (s *FileServer) refCopies(key, object string, add bool) error {
+	if err := s.store.ref(key, object, add); err != nil {
+		return err
+	}
+	return s.store.ref(hashKey(key), object, add)
+}
+
+// ref adds object to, or removes it from, the references of key. A key left
+// without references after a release is deleted, keys that never had any,
+// like copies fetched for reading, are kept.
+func (s *Store) ref(key, object string, add bool) error {
+	refs, changed, err := s.index.Ref(key, object, add)
+	if err != nil || add || !changed || len(refs) > 0 {
+		return err
+	}
+	log.Printf("[%s] no references left, deleting\n", key)
+	return s.Delete(key)
+}
+
+// DedupStats reports how much sharing chunks saves on this node.
+func (s *FileServer) DedupStats() DedupStats {
+	var stats DedupStats
+	for _, bucket := range []string{chunkBucket, shardBucket, encChunkBucket, encShardBucket, convChunkBucket, convShardBucket} {
+		for _, entry := range s.store.index.Entries(bucket + "/") {
+			if entry.Cached {
+				continue
+			}
+			refs := max(len(entry.Refs), 1)
+			stats.Chunks++
+			stats.Refs += len(entry.Refs)
+			stats.Physical += entry.Size
+			stats.Logical += entry.Size * int64(refs)
+		}
+	}
+	return stats
+}
+
+func (s *FileServer) handleMessageHasKeys(from string, msg MessageHasKeys) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer [%s] does not exist in peer map", from)
+	}
+
+	has := make([]byte, len(msg.Keys))
+	for i, key := range msg.Keys {
+		if s.store.Has(key) {
+			has[i] = 1
+		}
+	}
+
+	return reply(peer, has)
+}
+
+func (s *FileServer) handleMessageChunkRefs(from string, msg MessageChunkRefs) error {
+	for _, key := range msg.Keys {
+		if err := s.refCopies(key, msg.Object, !msg.Release); err != nil {
+			return err
+		}
+	}
+	return nil
+}
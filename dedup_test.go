@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestChunkDedup(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	// chunks of 8 bytes, the two versions share their first two chunks
+	v1 := []byte("sharedAAsharedBBonly-v1!")
+	v2 := []byte("sharedAAsharedBBonly-v2!")
+	for key, data := range map[string][]byte{"v1": v1, "v2": v2} {
+		if err := s.Store(DefaultBucket, key, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := s.DedupStats()
+	if stats.Chunks != 4 || stats.Refs != 6 {
+		t.Errorf("have %d chunks %d refs want 4 chunks 6 refs", stats.Chunks, stats.Refs)
+	}
+	if stats.Ratio() != 1.5 {
+		t.Errorf("have ratio %.2f want 1.50", stats.Ratio())
+	}
+
+	// storing a version again takes no new reference
+	if err := s.Store(DefaultBucket, "v1", bytes.NewReader(v1)); err != nil {
+		t.Fatal(err)
+	}
+	if have := s.DedupStats().Refs; have != 6 {
+		t.Errorf("have %d refs want 6", have)
+	}
+
+	if err := s.Delete(DefaultBucket, "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if have := s.DedupStats().Chunks; have != 3 {
+		t.Errorf("have %d chunks after deleting v1 want 3", have)
+	}
+	r, err := s.Get(DefaultBucket, "v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := io.ReadAll(r); !bytes.Equal(out, v2) {
+		t.Errorf("have %s want %s", out, v2)
+	}
+
+	if err := s.Delete(DefaultBucket, "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if have := s.DedupStats(); have.Chunks != 0 {
+		t.Errorf("have %d chunks after deleting every version want 0", have.Chunks)
+	}
+}
+
+func TestEncryptedChunksApart(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	for _, cfg := range []BucketConfig{{Name: "plain"}, {Name: "secret", Encrypt: true}} {
+		if err := s.PutBucket(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := []byte("same content in a plain and an encrypted bucket")
+	for _, bucket := range []string{"plain", "secret"} {
+		if err := s.Store(bucket, "doc", bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// replicas of the chunks differ, so the buckets share none of them
+	if have := s.DedupStats(); have.Refs != have.Chunks {
+		t.Errorf("have %d refs to %d chunks want no shared chunk", have.Refs, have.Chunks)
+	}
+	r, err := s.Get("secret", "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := io.ReadAll(r); !bytes.Equal(out, data) {
+		t.Errorf("have %s want %s", out, data)
+	}
+}
+
+func TestFailedStoreDropsChunks(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	shared := []byte("sharedAA")
+	if err := s.Store(DefaultBucket, "kept", bytes.NewReader(shared)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the reader fails after the shared chunk and two new ones
+	data := []byte("sharedAAnew-1!!!new-2!!!new-3!!!")
+	if err := s.Store(DefaultBucket, "doc", &failingReader{r: bytes.NewReader(data), n: 24}); err == nil {
+		t.Fatal("expected the store to fail")
+	}
+	if have := s.DedupStats(); have.Chunks != 1 || have.Refs != 1 {
+		t.Errorf("have %d chunks %d refs want only the chunk of the kept object", have.Chunks, have.Refs)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/vasanthgk02/distributed_file_system/p2p"
+)
+
+// When an object is overwritten, the chunks that changed are usually close to
+// the chunks they replace. Instead of sending a changed chunk in full, the
+// sender asks the replica for the block signatures of the chunk it replaces,
+// the basis, and sends only a delta against it, rsync style. The replica
+// rebuilds the chunk from its basis and the delta, and checks it against the
+// chunk ID before storing it.
+
+// deltaBlockSize is the size of the blocks of a basis a delta can refer to.
+const deltaBlockSize = 2048
+
+// BlockSig is the signature of one block of a basis, a cheap rolling checksum
+// to find candidate matches and a strong hash to confirm them.
+type BlockSig struct {
+	Weak   uint32
+	Strong [16]byte
+}
+
+// DeltaOp either copies block Block of the basis, or, with Block set to -1,
+// inserts Data.
+type DeltaOp struct {
+	Block int
+	Data  []byte
+}
+
+// MessageSignatures asks a peer for the block signatures of its replica of
+// Basis. The peer replies with the length of the gob encoded signatures,
+// FILE_NOT_FOUND if it does not hold Basis, followed by the signatures.
+type MessageSignatures struct {
+	Basis     string
+	BlockSize int
+	Encrypted bool
+}
+
+// MessageApplyDelta is followed by a stream of Size bytes holding the gob
+// encoded delta, encrypted if Encrypted is set. The peer applies it to its
+// replica of Basis and stores the result as its replica of Key.
+type MessageApplyDelta struct {
+	Basis     string
+	Key       string
+	Name      string // original key, recorded by the replica for listing
+	BlockSize int
+	Size      int64 // bytes of the stream following the message
+	Length    int64 // length of the rebuilt data
+	Encrypted bool
+	Checksum  string // hex SHA-256 of the rebuilt data
+}
+
+// weakSum is the rsync rolling checksum of a block.
+type weakSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newWeakSum(block []byte) weakSum {
+	w := weakSum{n: uint32(len(block))}
+	for i, x := range block {
+		w.a += uint32(x)
+		w.b += uint32(len(block)-i) * uint32(x)
+	}
+	return w
+}
+
+// roll slides the block one byte, dropping out and taking in.
+func (w *weakSum) roll(out, in byte) {
+	w.a += uint32(in) - uint32(out)
+	w.b += w.a - w.n*uint32(out)
+}
+
+func (w weakSum) sum() uint32 {
+	return w.b<<16 | w.a&0xffff
+}
+
+func strongSum(block []byte) [16]byte {
+	var s [16]byte
+	hash := sha256.Sum256(block)
+	copy(s[:], hash[:])
+	return s
+}
+
+// signatures returns the signatures of the full blocks of basis.
+func signatures(basis []byte, blockSize int) []BlockSig {
+	sigs := make([]BlockSig, 0, len(basis)/blockSize)
+	for off := 0; off+blockSize <= len(basis); off += blockSize {
+		block := basis[off : off+blockSize]
+		sigs = append(sigs, BlockSig{Weak: newWeakSum(block).sum(), Strong: strongSum(block)})
+	}
+	return sigs
+}
+
+// makeDelta describes data as blocks of the basis sigs were made of and
+// literal bytes in between.
+func makeDelta(sigs []BlockSig, blockSize int, data []byte) []DeltaOp {
+	blocks := make(map[uint32][]int, len(sigs))
+	for i, sig := range sigs {
+		blocks[sig.Weak] = append(blocks[sig.Weak], i)
+	}
+	find := func(weak uint32, block []byte) int {
+		for _, i := range blocks[weak] {
+			if sigs[i].Strong == strongSum(block) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	var (
+		ops   []DeltaOp
+		lit   = 0 // start of the literal bytes not yet added to ops
+		off   = 0
+		weak  weakSum
+		fresh = true
+	)
+	for off+blockSize <= len(data) {
+		if fresh {
+			weak = newWeakSum(data[off : off+blockSize])
+			fresh = false
+		}
+		if i := find(weak.sum(), data[off:off+blockSize]); i >= 0 {
+			if lit < off {
+				ops = append(ops, DeltaOp{Block: -1, Data: data[lit:off]})
+			}
+			ops = append(ops, DeltaOp{Block: i})
+			off += blockSize
+			lit, fresh = off, true
+			continue
+		}
+		if off+blockSize < len(data) {
+			weak.roll(data[off], data[off+blockSize])
+		}
+		off++
+	}
+	if lit < len(data) {
+		ops = append(ops, DeltaOp{Block: -1, Data: data[lit:]})
+	}
+	return ops
+}
+
+// applyDelta rebuilds the data described by ops from basis.
+func applyDelta(basis []byte, blockSize int, ops []DeltaOp) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for _, op := range ops {
+		if op.Block < 0 {
+			buf.Write(op.Data)
+			continue
+		}
+		off := op.Block * blockSize
+		if off+blockSize > len(basis) {
+			return nil, fmt.Errorf("delta refers to block %d beyond the basis", op.Block)
+		}
+		buf.Write(basis[off : off+blockSize])
+	}
+	return buf.Bytes(), nil
+}
+
+// basisAt returns the key of the chunk of old covering offset off, the chunk a
+// changed chunk at off most likely derives from. Erasure coded objects have
+// no whole chunks on peers to rebuild from.
+func basisAt(old Manifest, off int64) string {
+	if old.ErasureCoded() {
+		return ""
+	}
+	var pos int64
+	for _, ref := range old.Chunks {
+		if off < pos+ref.Size {
+			return old.chunkKey(ref.ID)
+		}
+		pos += ref.Size
+	}
+	return ""
+}
+
+// sendDeltas sends chunk, stored under key, as a delta against basis to the
+// peers holding basis. It returns the peers that still lack the chunk and
+// need it in full.
+func (s *FileServer) sendDeltas(cfg BucketConfig, peers []p2p.Peer, basis, key string, chunk []byte) []p2p.Peer {
+	var (
+		full    []p2p.Peer
+		patched []p2p.Peer
+	)
+	for _, peer := range peers {
+		if err := s.sendDelta(cfg, peer, basis, key, chunk); err != nil {
+			log.Printf("[%s] sending [%s] to [%s] in full: %s\n", s.Transport.ListenAddr(), key, peer.RemoteAddr(), err)
+			full = append(full, peer)
+			continue
+		}
+		patched = append(patched, peer)
+	}
+
+	// a peer that failed to apply the delta does not hold the chunk
+	return append(full, s.lacking(patched, key)...)
+}
+
+var errNoGain = errors.New("delta is not smaller than the chunk")
+
+func (s *FileServer) sendDelta(cfg BucketConfig, peer p2p.Peer, basis, key string, chunk []byte) error {
+	msg := Message{
+		Payload: MessageSignatures{
+			Basis:     hashKey(basis),
+			BlockSize: deltaBlockSize,
+			Encrypted: cfg.Encrypt,
+		},
+	}
+	var sigs []BlockSig
+	found := false
+	err := s.collectFrom([]p2p.Peer{peer}, &msg, func(peer p2p.Peer) error {
+		var size int64
+		if err := binary.Read(peer, binary.LittleEndian, &size); err != nil {
+			return err
+		}
+		if size == FILE_NOT_FOUND {
+			return nil
+		}
+		found = true
+		return gob.NewDecoder(io.LimitReader(peer, size)).Decode(&sigs)
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("peer does not hold [%s]", basis)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(makeDelta(sigs, deltaBlockSize, chunk)); err != nil {
+		return err
+	}
+	if buf.Len() >= len(chunk) {
+		return errNoGain
+	}
+	wire := buf.Bytes()
+	if cfg.Encrypt {
+		enc := new(bytes.Buffer)
+		if _, err := copyEncrypt(s.Keystore.Active(), buf, enc); err != nil {
+			return err
+		}
+		wire = enc.Bytes()
+	}
+
+	hash := sha256.Sum256(chunk)
+	msg = Message{
+		Payload: MessageApplyDelta{
+			Basis:     hashKey(basis),
+			Key:       hashKey(key),
+			Name:      key,
+			BlockSize: deltaBlockSize,
+			Size:      int64(len(wire)),
+			Length:    int64(len(chunk)),
+			Encrypted: cfg.Encrypt,
+			Checksum:  hex.EncodeToString(hash[:]),
+		},
+	}
+	if err := s.streamTo([]p2p.Peer{peer}, &msg, wire); err != nil {
+		return err
+	}
+
+	log.Printf("[%s] sent [%s] to [%s] as a delta of %d bytes instead of %d\n", s.Transport.ListenAddr(), key, peer.RemoteAddr(), len(wire), len(chunk))
+	return nil
+}
+
+// handleMessageSignatures replies to peer on every path, sendDelta waits for
+// the reply while it holds the peer.
+func (s *FileServer) handleMessageSignatures(peer p2p.Peer, msg MessageSignatures) error {
+	basis, err := s.readCopy(msg.Basis, msg.Encrypted)
+	if err != nil || msg.BlockSize <= 0 {
+		return replyNotFound(peer)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(signatures(basis, msg.BlockSize)); err != nil {
+		replyNotFound(peer)
+		return err
+	}
+
+	return reply(peer, binary.LittleEndian.AppendUint64(nil, uint64(buf.Len())), buf.Bytes())
+}
+
+func (s *FileServer) handleMessageApplyDelta(peer p2p.Peer, msg MessageApplyDelta) error {
+	defer peer.CloseStream()
+	from := peer.RemoteAddr().String()
+
+	r := io.LimitReader(peer, msg.Size)
+	wire, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	delta := bytes.NewBuffer(wire)
+	if msg.Encrypted {
+		delta = new(bytes.Buffer)
+		if _, err := copyDecrypt(s.Keystore, bytes.NewReader(wire), delta); err != nil {
+			return err
+		}
+	}
+	var ops []DeltaOp
+	if err := gob.NewDecoder(delta).Decode(&ops); err != nil {
+		return err
+	}
+
+	basis, err := s.readCopy(msg.Basis, msg.Encrypted)
+	if err != nil {
+		return err
+	}
+	data, err := applyDelta(basis, msg.BlockSize, ops)
+	if err != nil {
+		return err
+	}
+	if hash := sha256.Sum256(data); hex.EncodeToString(hash[:]) != msg.Checksum {
+		return fmt.Errorf("delta from %s: %w", from, &IntegrityError{Key: msg.Key, Want: msg.Checksum, Have: hex.EncodeToString(hash[:])})
+	}
+
+	stored := bytes.NewBuffer(data)
+	check := writeCheck{Plain: msg.Checksum}
+	if msg.Encrypted {
+		cfg, err := s.copyConfig(msg.Name)
+		if err != nil {
+			return err
+		}
+		stored = new(bytes.Buffer)
+		if _, err := s.encryptCopy(cfg, data, stored); err != nil {
+			return err
+		}
+		check.Keys = s.Keystore
+	}
+	_, err = s.store.writeVerified(msg.Key, msg.Name, msg.Length, check, stored)
+	return err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestDelta(t *testing.T) {
+	basis := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(basis)
+
+	edits := map[string][]byte{
+		"unchanged": bytes.Clone(basis),
+		"modified":  append(append(bytes.Clone(basis[:5000]), 'x'), basis[5001:]...),
+		"inserted":  append(append(bytes.Clone(basis[:5000]), []byte("inserted")...), basis[5000:]...),
+		"removed":   append(bytes.Clone(basis[:5000]), basis[5100:]...),
+		"truncated": bytes.Clone(basis[:10000]),
+	}
+
+	sigs := signatures(basis, deltaBlockSize)
+	for name, data := range edits {
+		ops := makeDelta(sigs, deltaBlockSize, data)
+
+		have, err := applyDelta(basis, deltaBlockSize, ops)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !bytes.Equal(have, data) {
+			t.Errorf("%s: rebuilt data differs", name)
+		}
+
+		literal := 0
+		for _, op := range ops {
+			literal += len(op.Data)
+		}
+		if literal > 2*deltaBlockSize {
+			t.Errorf("%s: have %d literal bytes want at most %d", name, literal, 2*deltaBlockSize)
+		}
+	}
+
+	if _, err := applyDelta(basis[:100], deltaBlockSize, []DeltaOp{{Block: 3}}); err == nil {
+		t.Error("expected an error for a block beyond the basis")
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reed-Solomon erasure coding over GF(2^8). An object is split into data
+// shards and extended with parity shards, any data-shard-many of them are
+// enough to rebuild the object.
+
+var ErrTooFewShards = errors.New("too few shards to reconstruct")
+
+var (
+	gfExp [512]byte
+	gfLog [256]byte
+)
+
+func init() {
+	// generator 2 over the polynomial x^8 + x^4 + x^3 + x^2 + 1
+	x := 1
+	for i := range 255 {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])*n)%255]
+}
+
+type gfMatrix [][]byte
+
+func newGFMatrix(rows, cols int) gfMatrix {
+	m := make(gfMatrix, rows)
+	for i := range m {
+		m[i] = make([]byte, cols)
+	}
+	return m
+}
+
+func (m gfMatrix) mul(o gfMatrix) gfMatrix {
+	out := newGFMatrix(len(m), len(o[0]))
+	for i := range m {
+		for j := range o[0] {
+			var v byte
+			for k := range o {
+				v ^= gfMul(m[i][k], o[k][j])
+			}
+			out[i][j] = v
+		}
+	}
+	return out
+}
+
+// invert returns the inverse of the square matrix m by Gauss-Jordan
+// elimination.
+func (m gfMatrix) invert() (gfMatrix, error) {
+	n := len(m)
+	work := newGFMatrix(n, 2*n)
+	for i := range m {
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+
+	for col := range n {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		inv := gfInv(work[col][col])
+		for j := range work[col] {
+			work[col][j] = gfMul(work[col][j], inv)
+		}
+		for row := range n {
+			if row == col || work[row][col] == 0 {
+				continue
+			}
+			factor := work[row][col]
+			for j := range work[row] {
+				work[row][j] ^= gfMul(factor, work[col][j])
+			}
+		}
+	}
+
+	out := newGFMatrix(n, n)
+	for i := range out {
+		copy(out[i], work[i][n:])
+	}
+	return out, nil
+}
+
+// ReedSolomon encodes DataShards data shards into ParityShards extra parity
+// shards. The code is systematic: data shards are stored as they are.
+type ReedSolomon struct {
+	DataShards   int
+	ParityShards int
+
+	// encoding matrix, the identity on top of the parity rows
+	matrix gfMatrix
+}
+
+func NewReedSolomon(dataShards, parityShards int) (*ReedSolomon, error) {
+	if dataShards <= 0 || parityShards <= 0 || dataShards+parityShards > 256 {
+		return nil, fmt.Errorf("invalid erasure coding %d+%d", dataShards, parityShards)
+	}
+
+	// a Vandermonde matrix made systematic stays invertible for every
+	// choice of dataShards rows
+	total := dataShards + parityShards
+	vm := newGFMatrix(total, dataShards)
+	for i := range vm {
+		for j := range vm[i] {
+			vm[i][j] = gfPow(byte(i), j)
+		}
+	}
+	top, err := vm[:dataShards].invert()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReedSolomon{
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		matrix:       vm.mul(top),
+	}, nil
+}
+
+// Split cuts b into DataShards equally sized shards, zero padding the last,
+// and appends empty parity shards to be filled by Encode.
+func (rs *ReedSolomon) Split(b []byte) [][]byte {
+	shardSize := (len(b) + rs.DataShards - 1) / rs.DataShards
+	if shardSize == 0 {
+		shardSize = 1
+	}
+
+	shards := make([][]byte, rs.DataShards+rs.ParityShards)
+	for i := range shards {
+		shards[i] = make([]byte, shardSize)
+		if i < rs.DataShards && i*shardSize < len(b) {
+			copy(shards[i], b[i*shardSize:])
+		}
+	}
+	return shards
+}
+
+// Encode computes the parity shards from the data shards.
+func (rs *ReedSolomon) Encode(shards [][]byte) error {
+	if len(shards) != rs.DataShards+rs.ParityShards {
+		return fmt.Errorf("have %d shards want %d", len(shards), rs.DataShards+rs.ParityShards)
+	}
+	rs.codeShards(rs.matrix[rs.DataShards:], shards[:rs.DataShards], shards[rs.DataShards:])
+	return nil
+}
+
+// Reconstruct rebuilds the missing shards, given as nil, from any DataShards
+// of the others.
+func (rs *ReedSolomon) Reconstruct(shards [][]byte) error {
+	if len(shards) != rs.DataShards+rs.ParityShards {
+		return fmt.Errorf("have %d shards want %d", len(shards), rs.DataShards+rs.ParityShards)
+	}
+
+	var (
+		rows    = newGFMatrix(0, 0)
+		present = make([][]byte, 0, rs.DataShards)
+	)
+	for i, shard := range shards {
+		if shard == nil || len(present) == rs.DataShards {
+			continue
+		}
+		rows = append(rows, rs.matrix[i])
+		present = append(present, shard)
+	}
+	if len(present) < rs.DataShards {
+		return ErrTooFewShards
+	}
+
+	decode, err := rows.invert()
+	if err != nil {
+		return err
+	}
+
+	shardSize := len(present[0])
+	data := make([][]byte, rs.DataShards)
+	for i := range data {
+		if shards[i] != nil {
+			data[i] = shards[i]
+		} else {
+			data[i] = make([]byte, shardSize)
+		}
+	}
+	rs.codeShards(decode, present, data)
+	for i := range data {
+		shards[i] = data[i]
+	}
+
+	for i := rs.DataShards; i < len(shards); i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, shardSize)
+			rs.codeShards(rs.matrix[i:i+1], data, shards[i:i+1])
+		}
+	}
+	return nil
+}
+
+// Join concatenates the data shards and trims the padding added by Split.
+func (rs *ReedSolomon) Join(shards [][]byte, size int) []byte {
+	b := make([]byte, 0, size)
+	for _, shard := range shards[:rs.DataShards] {
+		b = append(b, shard...)
+	}
+	return b[:size]
+}
+
+// codeShards sets out[i] to the combination of in given by matrix row i.
+func (rs *ReedSolomon) codeShards(matrix gfMatrix, in, out [][]byte) {
+	for i := range out {
+		row := make([]byte, len(out[i]))
+		for j := range in {
+			coef := matrix[i][j]
+			if coef == 0 {
+				continue
+			}
+			for k, b := range in[j] {
+				row[k] ^= gfMul(coef, b)
+			}
+		}
+		copy(out[i], row)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	rs, err := NewReedSolomon(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 1001)
+	rand.Read(data)
+
+	shards := rs.Split(data)
+	if err := rs.Encode(shards); err != nil {
+		t.Fatal(err)
+	}
+
+	// every pair of lost shards must be recoverable
+	for a := range shards {
+		for b := a + 1; b < len(shards); b++ {
+			damaged := make([][]byte, len(shards))
+			for i := range shards {
+				if i != a && i != b {
+					damaged[i] = append([]byte(nil), shards[i]...)
+				}
+			}
+			if err := rs.Reconstruct(damaged); err != nil {
+				t.Fatalf("lost %d and %d: %s", a, b, err)
+			}
+			if !bytes.Equal(rs.Join(damaged, len(data)), data) {
+				t.Fatalf("lost %d and %d: reconstructed data differs", a, b)
+			}
+			for i := range shards {
+				if !bytes.Equal(damaged[i], shards[i]) {
+					t.Fatalf("lost %d and %d: shard %d differs", a, b, i)
+				}
+			}
+		}
+	}
+
+	damaged := make([][]byte, len(shards))
+	copy(damaged, shards[:3])
+	if err := rs.Reconstruct(damaged); err != ErrTooFewShards {
+		t.Errorf("want ErrTooFewShards have %v", err)
+	}
+}
+
+func TestErasureCodedTooFewPeers(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	if err := s.PutBucket(BucketConfig{Name: "ec", DataShards: 2, ParityShards: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store("ec", "doc", bytes.NewReader([]byte("needs three peers"))); !errors.Is(err, ErrTooFewPeers) {
+		t.Errorf("have %v want %v", err, ErrTooFewPeers)
+	}
+}
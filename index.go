@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	indexDirName      = ".index"
+	indexLogName      = "index.log"
+	indexSnapshotName = "index.snap"
+
+	// DefaultSnapshotEvery is the number of log records after which the index
+	// writes a fresh snapshot and truncates its log.
+	DefaultSnapshotEvery = 1000
+)
+
+// IndexEntry is what the index knows about a single object on disk.
+type IndexEntry struct {
+	Key      string // key the object is stored under
+	Name     string // original key, differs from Key on replicas
+	PathKey  PathKey
+	Size     int64  // bytes on disk
+	Length   int64  // length of the original object
+	Checksum string // hex SHA-256 of the bytes on disk
+	Plain    string // hex SHA-256 of the original data, empty if unknown
+	KeyID    string // of the master key encrypted copies are encrypted with
+	Version  uint64
+	ModTime  time.Time
+
+	// Refs lists the objects referencing a chunk or shard, sorted. Other
+	// entries have none.
+	Refs []string
+
+	// Cached is set on copies fetched to serve reads, which may be evicted.
+	Cached bool
+
+	// Corrupt is set by Reconcile on files that no longer have the size they
+	// were written with, for the scrubber to repair first.
+	Corrupt bool
+}
+
+func (e IndexEntry) Info() ObjectInfo {
+	return ObjectInfo{Key: e.Name, Size: e.Length, ModTime: e.ModTime}
+}
+
+type indexOp string
+
+const (
+	indexOpPut indexOp = "put"
+	indexOpDel indexOp = "del"
+)
+
+type indexRecord struct {
+	Op    indexOp
+	Entry IndexEntry
+}
+
+// Index maps store keys to their IndexEntry. Every change is appended to a log
+// and the whole map is snapshotted every SnapshotEvery records, so the index
+// is rebuilt on startup by loading the snapshot and replaying the log.
+type Index struct {
+	SnapshotEvery int
+
+	mu      sync.RWMutex
+	dir     string
+	entries map[string]IndexEntry
+	log     *os.File
+	records int // records appended since the last snapshot
+}
+
+// OpenIndex loads the index kept in dir. The directory is only created once
+// the index is first written to.
+func OpenIndex(dir string) (*Index, error) {
+	idx := &Index{
+		SnapshotEvery: DefaultSnapshotEvery,
+		dir:           dir,
+		entries:       make(map[string]IndexEntry),
+	}
+	if err := idx.load(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (idx *Index) path(name string) string {
+	return fmt.Sprintf("%s/%s", idx.dir, name)
+}
+
+func (idx *Index) load() error {
+	b, err := os.ReadFile(idx.path(indexSnapshotName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &idx.entries); err != nil {
+			return fmt.Errorf("corrupt index snapshot: %w", err)
+		}
+	}
+
+	f, err := os.Open(idx.path(indexLogName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// a crash may leave a partially written last record behind
+			if len(line) > 0 {
+				log.Printf("index: dropping torn record at the end of %s\n", idx.path(indexLogName))
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var rec indexRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("corrupt index log: %w", err)
+		}
+		idx.apply(rec)
+		idx.records++
+	}
+}
+
+func (idx *Index) apply(rec indexRecord) {
+	switch rec.Op {
+	case indexOpPut:
+		idx.entries[rec.Entry.Key] = rec.Entry
+	case indexOpDel:
+		delete(idx.entries, rec.Entry.Key)
+	}
+}
+
+// append logs rec, applies it and snapshots the index when it is due.
+// idx.mu must be held for writing.
+func (idx *Index) append(rec indexRecord) error {
+	if idx.log == nil {
+		if err := os.MkdirAll(idx.dir, os.ModePerm); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(idx.path(indexLogName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		idx.log = f
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := idx.log.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err := idx.log.Sync(); err != nil {
+		return err
+	}
+	idx.apply(rec)
+
+	idx.records++
+	if idx.SnapshotEvery > 0 && idx.records >= idx.SnapshotEvery {
+		return idx.snapshot()
+	}
+	return nil
+}
+
+// snapshot writes all entries to a new snapshot and truncates the log. The
+// log is only truncated once the snapshot is on disk, so that a crash leaves
+// either the old snapshot and the log or the new snapshot behind.
+// idx.mu must be held for writing.
+func (idx *Index) snapshot() error {
+	b, err := json.Marshal(idx.entries)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(idx.path(indexSnapshotName + ".tmp"))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), idx.path(indexSnapshotName)); err != nil {
+		return err
+	}
+	syncDir(idx.dir)
+
+	if err := idx.log.Sync(); err != nil {
+		return err
+	}
+	if err := idx.log.Truncate(0); err != nil {
+		return err
+	}
+	idx.records = 0
+	return nil
+}
+
+// Put records entry, bumping its version past the one already indexed. The
+// references of the indexed entry are kept, they only change through Ref.
+func (idx *Index) Put(entry IndexEntry) (IndexEntry, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	cur := idx.entries[entry.Key]
+	entry.Version = cur.Version + 1
+	entry.Refs = cur.Refs
+	return entry, idx.append(indexRecord{Op: indexOpPut, Entry: entry})
+}
+
+// Ref adds object to the references of key, or removes it when add is false.
+// Adding a reference twice counts it once. It returns the references left and
+// whether the references changed, keys that are not indexed never change.
+func (idx *Index) Ref(key, object string, add bool) ([]string, bool, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	entry, ok := idx.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	i := sort.SearchStrings(entry.Refs, object)
+	has := i < len(entry.Refs) && entry.Refs[i] == object
+	if has == add {
+		return entry.Refs, false, nil
+	}
+
+	refs := make([]string, 0, len(entry.Refs)+1)
+	refs = append(refs, entry.Refs[:i]...)
+	if add {
+		refs = append(refs, object)
+		refs = append(refs, entry.Refs[i:]...)
+	} else {
+		refs = append(refs, entry.Refs[i+1:]...)
+	}
+	entry.Refs = refs
+	entry.Version++
+	return refs, true, idx.append(indexRecord{Op: indexOpPut, Entry: entry})
+}
+
+func (idx *Index) Delete(key string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if _, ok := idx.entries[key]; !ok {
+		return nil
+	}
+	return idx.append(indexRecord{Op: indexOpDel, Entry: IndexEntry{Key: key}})
+}
+
+func (idx *Index) Get(key string) (IndexEntry, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	entry, ok := idx.entries[key]
+	return entry, ok
+}
+
+// Entries returns the entries whose original key starts with prefix, sorted
+// by original key.
+func (idx *Index) Entries(prefix string) []IndexEntry {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	entries := []IndexEntry{}
+	for _, entry := range idx.entries {
+		if strings.HasPrefix(entry.Name, prefix) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name == entries[j].Name {
+			return entries[i].Key < entries[j].Key
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+// Close snapshots the index so that the next start does not replay the log.
+// An index that was never written to is left untouched.
+func (idx *Index) Close() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.log == nil {
+		return nil
+	}
+	err := idx.snapshot()
+	idx.log.Close()
+	idx.log = nil
+	return err
+}
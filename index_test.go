@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestIndexReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	idx, err := OpenIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.SnapshotEvery = 3
+
+	for _, key := range []string{"a", "b", "c", "d", "a"} {
+		if _, err := idx.Put(IndexEntry{Key: key, Name: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := idx.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen without Close, so that the log has to be replayed on top of the snapshot
+	reopened, err := OpenIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if _, ok := reopened.Get("b"); ok {
+		t.Errorf("expected b to be deleted")
+	}
+	entry, ok := reopened.Get("a")
+	if !ok || entry.Version != 2 {
+		t.Errorf("want a at version 2, have %+v", entry)
+	}
+	if n := len(reopened.Entries("")); n != 3 {
+		t.Errorf("want 3 entries have %d", n)
+	}
+}
+
+func TestStoreReconcile(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransfromFunc: CASPathTransform})
+	defer s.Close()
+
+	for _, key := range []string{"foo", "bar"} {
+		if _, err := s.Write(key, bytes.NewReader([]byte("some data"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// drift behind the back of the index
+	os.Remove(s.Root + "/" + CASPathTransform("foo").FullPath())
+	orphan, _ := s.createTemp("baz")
+	orphan.Close()
+	os.WriteFile(s.Root+"/"+CASPathTransform("bar").FullPath(), []byte("changed"), 0644)
+
+	report, err := s.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Missing) != 1 || report.Missing[0] != "foo" {
+		t.Errorf("want foo missing, have %+v", report)
+	}
+	if len(report.Changed) != 1 || report.Changed[0] != "bar" {
+		t.Errorf("want bar changed, have %+v", report)
+	}
+	if len(report.Orphaned) != 1 || report.Orphaned[0] != orphan.Name() {
+		t.Errorf("want the temp file of baz orphaned, have %+v", report)
+	}
+	if _, err := os.Stat(orphan.Name()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the orphaned temp file to be removed")
+	}
+	if s.Has("foo") {
+		t.Errorf("expected foo to be dropped from the index")
+	}
+	if entry, _ := s.index.Get("bar"); !entry.Corrupt || entry.Size != int64(len("some data")) {
+		t.Errorf("want bar marked corrupt with its written size, have %+v", entry)
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A keystore keeps the master keys of a node on disk, wrapped with a key
+// encryption key derived from a passphrase or read from a key file, so that
+// a node still decrypts what its peers send it after a restart. Every node of
+// a cluster must hold the same master keys. The first one is derived from the
+// passphrase or key file, so nodes given the same one start out with the same
+// key, later ones are handed to the peers when they are rotated in. Nodes
+// check at handshake that they hold the key their peer encrypts with. Keys
+// are known by an ID derived from the key, which every encrypted stream
+// records in its header and the index records for every encrypted file.
+// Rotating adds a new active key, the older ones are retired once no file
+// records them anymore.
+
+// DefaultKeystoreName is the file in the storage root a node keeps its
+// keystore in unless told otherwise.
+const DefaultKeystoreName = ".keystore"
+
+const (
+	keystoreVersion = 1
+	kdfPBKDF2       = "pbkdf2-sha256"
+	kdfKeyFile      = "keyfile"
+
+	// pbkdf2Iterations follows the OWASP recommendation for PBKDF2-SHA256.
+	pbkdf2Iterations = 600_000
+
+	// firstKeyLabel separates the first master key from the key encryption
+	// key derived from the same passphrase or key file.
+	firstKeyLabel = "dfs first master key"
+)
+
+var (
+	ErrUnknownKey     = errors.New("unknown encryption key")
+	ErrKeystoreLocked = errors.New("keystore does not open with this passphrase or key file")
+)
+
+// KeySource unlocks a keystore: a passphrase, or a file holding a 32 byte
+// key, raw or hex encoded. The key file wins if both are set.
+type KeySource struct {
+	Passphrase string
+	KeyFile    string
+}
+
+// MasterKey is a key of a keystore.
+type MasterKey struct {
+	ID  string // hex, derived from the key
+	Key []byte
+}
+
+// wrappedKey is a master key as kept on disk, sealed with AES-GCM under the
+// key encryption key, the nonce first.
+type wrappedKey struct {
+	ID      string
+	Wrapped []byte
+	Created time.Time
+}
+
+type keystoreFile struct {
+	Version    int
+	KDF        string
+	Salt       []byte       `json:",omitempty"`
+	Iterations int          `json:",omitempty"`
+	Keys       []wrappedKey // oldest first
+	Active     string
+}
+
+// Keystore holds the master keys of a node, the active one encrypting what
+// the node writes from now on.
+type Keystore struct {
+	mu   sync.RWMutex
+	path string // empty for a keystore kept in memory
+	kek  []byte
+	file keystoreFile
+	keys map[string][]byte
+	ids  []string // oldest first
+}
+
+// keyID derives the ID of a master key, which does not reveal the key.
+func keyID(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("dfs master key id"))
+	return hex.EncodeToString(mac.Sum(nil)[:encKeyIDSize])
+}
+
+// NewKeystore returns a keystore kept in memory holding key alone, as
+// FileServerOpts.EncKey configures it.
+func NewKeystore(key []byte) *Keystore {
+	ks := &Keystore{keys: make(map[string][]byte)}
+	id := keyID(key)
+	ks.keys[id] = key
+	ks.ids = []string{id}
+	ks.file.Active = id
+	return ks
+}
+
+// OpenKeystore loads the keystore at path, unlocked by src. A keystore that
+// does not exist yet is created with a master key derived from src.
+func OpenKeystore(path string, src KeySource) (*Keystore, error) {
+	ks := &Keystore{path: path, keys: make(map[string][]byte)}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := ks.create(src); err != nil {
+			return nil, err
+		}
+		return ks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &ks.file); err != nil {
+		return nil, fmt.Errorf("corrupt keystore %s: %w", path, err)
+	}
+	if ks.file.Version != keystoreVersion {
+		return nil, fmt.Errorf("unsupported keystore version %d", ks.file.Version)
+	}
+	if ks.kek, err = deriveKEK(src, ks.file.KDF, ks.file.Salt, ks.file.Iterations); err != nil {
+		return nil, err
+	}
+	for _, wk := range ks.file.Keys {
+		key, err := unwrapKey(ks.kek, wk)
+		if err != nil {
+			return nil, err
+		}
+		ks.keys[wk.ID] = key
+		ks.ids = append(ks.ids, wk.ID)
+	}
+	if ks.keys[ks.file.Active] == nil {
+		return nil, fmt.Errorf("corrupt keystore %s: no active key", path)
+	}
+	return ks, nil
+}
+
+func (ks *Keystore) create(src KeySource) error {
+	ks.file = keystoreFile{Version: keystoreVersion, KDF: kdfKeyFile}
+	if src.KeyFile == "" {
+		ks.file.KDF = kdfPBKDF2
+		ks.file.Salt = make([]byte, 16)
+		ks.file.Iterations = pbkdf2Iterations
+		if _, err := rand.Read(ks.file.Salt); err != nil {
+			return err
+		}
+	}
+	kek, err := deriveKEK(src, ks.file.KDF, ks.file.Salt, ks.file.Iterations)
+	if err != nil {
+		return err
+	}
+	ks.kek = kek
+
+	key, err := firstMasterKey(src)
+	if err != nil {
+		return err
+	}
+	wk, err := wrapKey(ks.kek, key)
+	if err != nil {
+		return err
+	}
+	ks.file.Keys = []wrappedKey{wk}
+	ks.file.Active = wk.ID
+	ks.keys[wk.ID] = key
+	ks.ids = []string{wk.ID}
+	return ks.save(ks.file)
+}
+
+// save writes file next to the file of the keystore and renames it into
+// place, so a crash never leaves it half written. A keystore kept in memory
+// saves nothing.
+func (ks *Keystore) save(file keystoreFile) error {
+	if ks.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ks.path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := ks.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ks.path)
+}
+
+// deriveKEK returns the key encryption key src stands for.
+func deriveKEK(src KeySource, kdf string, salt []byte, iterations int) ([]byte, error) {
+	switch kdf {
+	case kdfKeyFile:
+		if src.KeyFile == "" {
+			return nil, fmt.Errorf("%w: the keystore needs its key file", ErrKeystoreLocked)
+		}
+		return readKeyFile(src.KeyFile)
+	case kdfPBKDF2:
+		if src.Passphrase == "" {
+			return nil, fmt.Errorf("%w: the keystore needs its passphrase", ErrKeystoreLocked)
+		}
+		return pbkdf2.Key(sha256.New, src.Passphrase, salt, iterations, 32)
+	}
+	return nil, fmt.Errorf("unsupported key derivation %q", kdf)
+}
+
+// firstMasterKey derives the master key a keystore is created with from src.
+// It does not depend on the salt of the keystore, so every node unlocked by
+// the same passphrase or key file creates the same key.
+func firstMasterKey(src KeySource) ([]byte, error) {
+	if src.KeyFile != "" {
+		kek, err := readKeyFile(src.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		mac := hmac.New(sha256.New, kek)
+		mac.Write([]byte(firstKeyLabel))
+		return mac.Sum(nil), nil
+	}
+	return pbkdf2.Key(sha256.New, src.Passphrase, []byte(firstKeyLabel), pbkdf2Iterations, 32)
+}
+
+// readKeyFile reads a 32 byte key, raw or hex encoded.
+func readKeyFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := hex.DecodeString(strings.TrimSpace(string(b))); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("key file %s does not hold a 32 byte key", path)
+	}
+	return b, nil
+}
+
+func wrapKey(kek, key []byte) (wrappedKey, error) {
+	aead, err := newGCM(kek)
+	if err != nil {
+		return wrappedKey{}, err
+	}
+	id := keyID(key)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return wrappedKey{}, err
+	}
+	return wrappedKey{
+		ID:      id,
+		Wrapped: aead.Seal(nonce, nonce, key, []byte(id)),
+		Created: time.Now(),
+	}, nil
+}
+
+func unwrapKey(kek []byte, wk wrappedKey) ([]byte, error) {
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wk.Wrapped) < aead.NonceSize() {
+		return nil, ErrKeystoreLocked
+	}
+	nonce, sealed := wk.Wrapped[:aead.NonceSize()], wk.Wrapped[aead.NonceSize():]
+	key, err := aead.Open(nil, nonce, sealed, []byte(wk.ID))
+	if err != nil || keyID(key) != wk.ID {
+		return nil, ErrKeystoreLocked
+	}
+	return key, nil
+}
+
+// Active returns the key new data is encrypted with.
+func (ks *Keystore) Active() MasterKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return MasterKey{ID: ks.file.Active, Key: ks.keys[ks.file.Active]}
+}
+
+// Key returns the master key with the given ID. Data encrypted before keys
+// had IDs goes by the empty ID, and is taken to use the oldest key.
+func (ks *Keystore) Key(id string) ([]byte, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if id == "" {
+		id = ks.ids[0]
+	}
+	key, ok := ks.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// IDs returns the IDs of the keys of the keystore, oldest first.
+func (ks *Keystore) IDs() []string {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return slices.Clone(ks.ids)
+}
+
+// Rotate makes a new random key the active one and returns it. The keys
+// before it stay until Retire drops them.
+func (ks *Keystore) Rotate() (MasterKey, error) {
+	return ks.activate(newEncryptionKey())
+}
+
+// activate adds key unless the keystore holds it already and makes it the
+// active key.
+func (ks *Keystore) activate(key []byte) (MasterKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	id := keyID(key)
+	_, held := ks.keys[id]
+	file := ks.file
+	file.Active = id
+	if !held && ks.path != "" {
+		wk, err := wrapKey(ks.kek, key)
+		if err != nil {
+			return MasterKey{}, err
+		}
+		file.Keys = append(slices.Clone(file.Keys), wk)
+	}
+	if err := ks.save(file); err != nil {
+		return MasterKey{}, err
+	}
+
+	ks.file = file
+	if !held {
+		ks.keys[id] = key
+		ks.ids = append(ks.ids, id)
+	}
+	return MasterKey{ID: id, Key: key}, nil
+}
+
+// Retire drops every key but the active one and those in inUse, and returns
+// the IDs of the keys dropped. Data still encrypted with them no longer
+// decrypts.
+func (ks *Keystore) Retire(inUse map[string]bool) ([]string, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	keep := func(id string) bool { return id == ks.file.Active || inUse[id] }
+	file := ks.file
+	file.Keys = slices.DeleteFunc(slices.Clone(file.Keys), func(wk wrappedKey) bool {
+		return !keep(wk.ID)
+	})
+	if err := ks.save(file); err != nil {
+		return nil, err
+	}
+
+	ks.file = file
+	var retired, ids []string
+	for _, id := range ks.ids {
+		if keep(id) {
+			ids = append(ids, id)
+			continue
+		}
+		retired = append(retired, id)
+		delete(ks.keys, id)
+	}
+	ks.ids = ids
+	return retired, nil
+}
+
+// derive returns a keystore kept in memory holding a key derived from each
+// key of ks and context, under the ID of the key it is derived from.
+func (ks *Keystore) derive(context string) *Keystore {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	d := &Keystore{keys: make(map[string][]byte), ids: slices.Clone(ks.ids)}
+	d.file.Active = ks.file.Active
+	for id, key := range ks.keys {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(context))
+		d.keys[id] = mac.Sum(nil)
+	}
+	return d
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vasanthgk02/distributed_file_system/p2p"
+)
+
+func TestKeystorePassphrase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), DefaultKeystoreName)
+	ks, err := OpenKeystore(path, KeySource{Passphrase: "correct horse"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := ks.Active()
+	if len(active.Key) != 32 || active.ID != keyID(active.Key) {
+		t.Fatalf("have key %x with ID %s", active.Key, active.ID)
+	}
+	b, _ := os.ReadFile(path)
+	if bytes.Contains(b, active.Key) || bytes.Contains(b, []byte(hex.EncodeToString(active.Key))) {
+		t.Error("expected the key wrapped on disk")
+	}
+
+	// data encrypted before the restart still decrypts after it
+	enc := new(bytes.Buffer)
+	if _, err := copyEncrypt(active, bytes.NewReader([]byte("kept across restarts")), enc); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenKeystore(path, KeySource{Passphrase: "correct horse"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	if _, err := copyDecrypt(reopened, enc, out); err != nil || out.String() != "kept across restarts" {
+		t.Errorf("have %q %v", out, err)
+	}
+
+	// another node given the same passphrase starts out with the same key
+	other, err := OpenKeystore(filepath.Join(t.TempDir(), DefaultKeystoreName), KeySource{Passphrase: "correct horse"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Active().ID != active.ID {
+		t.Errorf("have key %s want %s from the same passphrase", other.Active().ID, active.ID)
+	}
+
+	if _, err := OpenKeystore(path, KeySource{Passphrase: "wrong"}); !errors.Is(err, ErrKeystoreLocked) {
+		t.Errorf("have %v want %v", err, ErrKeystoreLocked)
+	}
+	if _, err := OpenKeystore(path, KeySource{}); !errors.Is(err, ErrKeystoreLocked) {
+		t.Errorf("have %v want %v without a passphrase", err, ErrKeystoreLocked)
+	}
+}
+
+func TestKeystoreKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "kek")
+	if err := os.WriteFile(keyFile, []byte(hex.EncodeToString(newEncryptionKey())+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, DefaultKeystoreName)
+	ks, err := OpenKeystore(path, KeySource{KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenKeystore(path, KeySource{KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reopened.Active().Key, ks.Active().Key) {
+		t.Error("expected the same key after reopening")
+	}
+
+	other := filepath.Join(dir, "other")
+	os.WriteFile(other, newEncryptionKey(), 0600)
+	if _, err := OpenKeystore(path, KeySource{KeyFile: other}); !errors.Is(err, ErrKeystoreLocked) {
+		t.Errorf("have %v want %v", err, ErrKeystoreLocked)
+	}
+}
+
+func TestKeystoreRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), DefaultKeystoreName)
+	src := KeySource{Passphrase: "rotate"}
+	ks, err := OpenKeystore(path, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := ks.Active()
+	key, err := ks.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenKeystore(path, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Active().ID != key.ID || !reflect.DeepEqual(reopened.IDs(), []string{old.ID, key.ID}) {
+		t.Errorf("have active %s of %v want %s after %s", reopened.Active().ID, reopened.IDs(), key.ID, old.ID)
+	}
+	// data without a key ID keeps using the oldest key
+	if k, _ := reopened.Key(""); !bytes.Equal(k, old.Key) {
+		t.Error("expected the oldest key for data without a key ID")
+	}
+
+	if retired, err := reopened.Retire(nil); err != nil || !reflect.DeepEqual(retired, []string{old.ID}) {
+		t.Fatalf("have retired %v, %v want %s", retired, err, old.ID)
+	}
+	reopened, err = OpenKeystore(path, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reopened.IDs(), []string{key.ID}) {
+		t.Errorf("have %v want only %s", reopened.IDs(), key.ID)
+	}
+}
+
+func TestStoreRecordsKeyID(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	key := "replica"
+	enc := new(bytes.Buffer)
+	if _, err := copyEncrypt(s.Keystore.Active(), bytes.NewReader([]byte("encrypted replica")), enc); err != nil {
+		t.Fatal(err)
+	}
+	check := writeCheck{Keys: s.Keystore}
+	if _, err := s.store.writeVerified(key, "doc", -1, check, enc); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := s.store.index.Get(key); entry.KeyID != s.Keystore.Active().ID {
+		t.Errorf("have key ID %q want %q", entry.KeyID, s.Keystore.Active().ID)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	a, cleanupA := newTestServer(t)
+	defer cleanupA()
+	b, cleanupB := newTestServer(t)
+	defer cleanupB()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	handshake := func() (errA, errB error) {
+		done := make(chan error)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				done <- err
+				return
+			}
+			defer conn.Close()
+			done <- b.Handshake(p2p.NewTCPPeer(conn, false))
+		}()
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		errA = a.Handshake(p2p.NewTCPPeer(conn, true))
+		return errA, <-done
+	}
+
+	if errA, errB := handshake(); !errors.Is(errA, ErrUnknownKey) || !errors.Is(errB, ErrUnknownKey) {
+		t.Errorf("have %v and %v want %v for nodes with different keys", errA, errB, ErrUnknownKey)
+	}
+
+	key := newEncryptionKey()
+	a.Keystore, b.Keystore = NewKeystore(key), NewKeystore(key)
+	if errA, errB := handshake(); errA != nil || errB != nil {
+		t.Errorf("have %v and %v for nodes with the same key", errA, errB)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/vasanthgk02/distributed_file_system/p2p"
+)
+
+// DefaultListLimit is the page size used when List is called without a limit.
+const DefaultListLimit = 100
+
+// List returns up to limit objects of bucket whose key starts with prefix and
+// sorts after cursor, merged from the local store and every peer. An object
+// held by several nodes is reported once, by its most recent copy. The
+// returned cursor is empty once the listing is exhausted.
+func (s *FileServer) List(bucket, prefix, cursor string, limit int) ([]ObjectInfo, string, error) {
+	if _, err := s.bucket(bucket); err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+
+	// nodes index objects by their bucket qualified key
+	prefix = objectKey(bucket, prefix)
+	if cursor != "" {
+		cursor = objectKey(bucket, cursor)
+	}
+
+	// every node returns its own first page, one more than asked so that we
+	// can tell whether another page exists
+	infos, err := s.listKeys(prefix, cursor, limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+
+	page := paginate(infos, cursor, limit+1)
+	for i := range page {
+		page[i].Key = strings.TrimPrefix(page[i].Key, objectKey(bucket, ""))
+	}
+	if len(page) <= limit {
+		return page, "", nil
+	}
+	page = page[:limit]
+	return page, page[limit-1].Key, nil
+}
+
+// listKeys returns the keys starting with prefix, merged from the local store
+// and every peer and sorted by key. Peers only send the first limit keys that
+// sort after cursor.
+func (s *FileServer) listKeys(prefix, cursor string, limit int) ([]ObjectInfo, error) {
+	local, err := s.store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := make(map[string]ObjectInfo)
+	mergeInfos(merged, local)
+
+	msg := Message{
+		Payload: MessageListKeys{
+			Prefix: prefix,
+			Cursor: cursor,
+			Limit:  limit,
+		},
+	}
+	err = s.collect(&msg, func(peer p2p.Peer) error {
+		var size int64
+		if err := binary.Read(peer, binary.LittleEndian, &size); err != nil {
+			return err
+		}
+		if size == FILE_NOT_FOUND {
+			return nil
+		}
+		var infos []ObjectInfo
+		if err := gob.NewDecoder(io.LimitReader(peer, size)).Decode(&infos); err != nil {
+			return err
+		}
+		mergeInfos(merged, infos)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]ObjectInfo, 0, len(merged))
+	for _, info := range merged {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
+
+// collect broadcasts msg and hands the reply stream of every peer to fn.
+func (s *FileServer) collect(msg *Message, fn func(p2p.Peer) error) error {
+	return s.collectFrom(s.peerList(), msg, fn)
+}
+
+// collectFrom is collect limited to peers.
+func (s *FileServer) collectFrom(peers []p2p.Peer, msg *Message, fn func(p2p.Peer) error) error {
+	defer s.lockPeers(peers)()
+	if err := s.sendTo(peers, msg); err != nil {
+		return err
+	}
+
+	for _, peer := range peers {
+		if err := peer.AwaitStream(); err != nil {
+			continue
+		}
+		err := fn(peer)
+		peer.CloseStream()
+		if err != nil {
+			log.Printf("[%s] bad reply from peer [%s]: %s\n", s.Transport.ListenAddr(), peer.RemoteAddr(), err)
+		}
+	}
+	return nil
+}
+
+// mergeInfos adds infos to merged, keeping the newest copy of every key.
+func mergeInfos(merged map[string]ObjectInfo, infos []ObjectInfo) {
+	for _, info := range infos {
+		if cur, ok := merged[info.Key]; ok && !info.ModTime.After(cur.ModTime) {
+			continue
+		}
+		merged[info.Key] = info
+	}
+}
+
+// paginate returns at most limit entries of the sorted infos that come after
+// cursor. A limit <= 0 means no limit.
+func paginate(infos []ObjectInfo, cursor string, limit int) []ObjectInfo {
+	start := sort.Search(len(infos), func(i int) bool { return infos[i].Key > cursor })
+	infos = infos[start:]
+	if limit > 0 && len(infos) > limit {
+		infos = infos[:limit]
+	}
+	return infos
+}
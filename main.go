@@ -3,10 +3,13 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -37,13 +40,26 @@ func startRegularNode(addr string, bootstrapNodes []string) {
 	fmt.Println("Available commands:")
 	fmt.Println("  store <key> <file_path_or_data>  - Store file or data with key")
 	fmt.Println("  get <key>                        - Retrieve data by key")
+	fmt.Println("  range <key> <offset> <length>    - Retrieve part of the data by key")
+	fmt.Println("  stream <key> [cache]             - Retrieve data by key without a local copy")
 	fmt.Println("  delete <key>                     - Delete data by key")
+	fmt.Println("  ls [prefix] [cursor] [limit]     - List keys across the cluster")
+	fmt.Println("  mb <bucket> [setting=value...]   - Create or update a bucket")
+	fmt.Println("  buckets                          - List buckets and their settings")
 	fmt.Println("  quit                             - Exit the program")
 	fmt.Println("")
+	fmt.Println("Keys may be prefixed with their bucket as <bucket>/<key>, otherwise the")
+	fmt.Printf("%q bucket is used. Bucket settings: rf=<n> encrypt=<bool> quota=<bytes> retention=<duration>\n", DefaultBucket)
+	fmt.Println("ec=<data>+<parity> erasure codes the bucket instead of replicating it.")
+	fmt.Println("")
 	fmt.Println("Examples:")
 	fmt.Println("  store doc /home/user/document.txt")
 	fmt.Println("  store msg \"Hello World\"")
 	fmt.Println("  get doc")
+	fmt.Println("  ls do")
+	fmt.Println("  mb logs rf=2 quota=1048576 retention=72h")
+	fmt.Println("  mb cold ec=4+2")
+	fmt.Println("  store logs/today \"Hello World\"")
 	fmt.Println()
 
 	// Start interactive CLI
@@ -52,7 +68,8 @@ func startRegularNode(addr string, bootstrapNodes []string) {
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("Usage: ./fs --mode=<bootstrap|node> --port=<port> [--bootstrap=<addr1,addr2,...>]")
+		fmt.Println("Usage: ./fs --mode=<bootstrap|node> --port=<port> [--bootstrap=<addr1,addr2,...>] [--keystore=<path>] [--keyfile=<path>]")
+		fmt.Println("Nodes need the key file, or else the passphrase in $" + passphraseEnv + ", to unlock their keystore.")
 		fmt.Println("Examples:")
 		fmt.Println("  ./fs --mode=bootstrap --port=:3001")
 		fmt.Println("  ./fs --mode=bootstrap --port=:3002")
@@ -69,9 +86,15 @@ func main() {
 			port = arg[7:]
 		} else if len(arg) > 12 && arg[:12] == "--bootstrap=" {
 			bootstrapStr = arg[12:]
+		} else if len(arg) > 11 && arg[:11] == "--keystore=" {
+			keystorePath = arg[11:]
+		} else if len(arg) > 10 && arg[:10] == "--keyfile=" {
+			keySource.KeyFile = arg[10:]
 		}
 	}
 
+	keySource.Passphrase = os.Getenv(passphraseEnv)
+
 	if mode == "" || port == "" {
 		fmt.Println("Error: --mode and --port are required")
 		os.Exit(1)
@@ -149,6 +172,26 @@ func startCLI(s *FileServer) {
 				handleGet(s, key)
 			}
 			
+		case "range":
+			if len(parts) < 4 {
+				fmt.Println("Usage: range <key> <offset> <length>")
+			} else {
+				offset, err1 := strconv.ParseInt(parts[2], 10, 64)
+				length, err2 := strconv.ParseInt(parts[3], 10, 64)
+				if err1 != nil || err2 != nil {
+					fmt.Println("Usage: range <key> <offset> <length>")
+				} else {
+					handleGetRange(s, parts[1], offset, length)
+				}
+			}
+			
+		case "stream":
+			if len(parts) < 2 || (len(parts) > 2 && parts[2] != "cache") {
+				fmt.Println("Usage: stream <key> [cache]")
+			} else {
+				handleGetStream(s, parts[1], len(parts) > 2)
+			}
+			
 		case "delete":
 			if len(parts) < 2 {
 				fmt.Println("Usage: delete <key>")
@@ -157,6 +200,136 @@ func startCLI(s *FileServer) {
 				handleDelete(s, key)
 			}
 			
+		case "ls":
+			var prefix, cursor string
+			limit := DefaultListLimit
+			if len(parts) > 1 {
+				prefix = parts[1]
+			}
+			if len(parts) > 2 {
+				cursor = parts[2]
+			}
+			if len(parts) > 3 {
+				n, err := strconv.Atoi(parts[3])
+				if err != nil || n <= 0 {
+					fmt.Println("Usage: ls [prefix] [cursor] [limit]")
+					break
+				}
+				limit = n
+			}
+			handleList(s, prefix, cursor, limit)
+			
+		case "mb":
+			if len(parts) < 2 {
+				fmt.Println("Usage: mb <bucket> [rf=<n>] [encrypt=<bool>] [quota=<bytes>] [retention=<duration>] [ec=<data>+<parity>] [chunking=<fixed|cdc>]")
+			} else {
+				handleMakeBucket(s, parts[1], parts[2:])
+			}
+			
+		case "buckets":
+			handleBuckets(s)
+			
+		case "put":
+			if len(parts) < 2 {
+				fmt.Println("Usage: put <file_path_or_data>")
+			} else {
+				handlePutBlob(s, strings.Join(parts[1:], " "))
+			}
+			
+		case "cat":
+			if len(parts) < 2 {
+				fmt.Println("Usage: cat <blob_id>")
+			} else {
+				handleGetBlob(s, parts[1])
+			}
+			
+		case "adddir":
+			if len(parts) < 2 {
+				fmt.Println("Usage: adddir <dir_path>")
+			} else {
+				handleAddDir(s, parts[1])
+			}
+			
+		case "getdir":
+			if len(parts) < 3 {
+				fmt.Println("Usage: getdir <root_id> <dest_path>")
+			} else {
+				handleGetDir(s, parts[1], parts[2])
+			}
+			
+		case "upload":
+			if len(parts) < 3 {
+				fmt.Println("Usage: upload <key> <file_path>")
+			} else {
+				handleUpload(s, parts[1], parts[2])
+			}
+			
+		case "download":
+			if len(parts) < 3 {
+				fmt.Println("Usage: download <key> <dest_path>")
+			} else {
+				handleDownload(s, parts[1], parts[2])
+			}
+			
+		case "resume":
+			if len(parts) < 2 {
+				fmt.Println("Usage: resume <transfer_id> [file_path]")
+			} else {
+				handleResume(s, parts[1], parts[2:])
+			}
+			
+		case "transfers":
+			handleTransfers(s)
+			
+		case "abort":
+			if len(parts) < 2 {
+				fmt.Println("Usage: abort <transfer_id>")
+			} else {
+				handleAbort(s, parts[1])
+			}
+			
+		case "mpinit":
+			if len(parts) < 2 {
+				fmt.Println("Usage: mpinit <key>")
+			} else {
+				handleInitiateUpload(s, parts[1])
+			}
+			
+		case "mpput":
+			if len(parts) < 4 {
+				fmt.Println("Usage: mpput <upload_id> <part_number> <file_path_or_data>")
+			} else {
+				n, err := strconv.Atoi(parts[2])
+				if err != nil {
+					fmt.Println("Part number must be an integer")
+				} else {
+					handleUploadPart(s, parts[1], n, strings.Join(parts[3:], " "))
+				}
+			}
+			
+		case "mpcomplete":
+			if len(parts) < 2 {
+				fmt.Println("Usage: mpcomplete <upload_id>")
+			} else {
+				handleCompleteUpload(s, parts[1])
+			}
+			
+		case "mpabort":
+			if len(parts) < 2 {
+				fmt.Println("Usage: mpabort <upload_id>")
+			} else {
+				handleAbortUpload(s, parts[1])
+			}
+			
+		case "status":
+			handleStatus(s)
+			
+		case "rotate-key":
+			handleRotateKey(s)
+			
+		case "retire-key":
+			handleRetireKey(s)
+			
 		case "quit", "exit":
 			fmt.Println("Goodbye!")
 			s.Stop()
@@ -164,7 +337,7 @@ func startCLI(s *FileServer) {
 			
 		default:
 			fmt.Printf("Unknown command: %s\n", command)
-			fmt.Println("Available commands: store <key> <file_path_or_data>, get <key>, delete <key>, quit")
+			fmt.Println("Available commands: store <key> <file_path_or_data>, get <key>, range <key> <offset> <length>, stream <key> [cache], delete <key>, ls [prefix] [cursor] [limit], mb <bucket> [setting=value...], buckets, put <file_path_or_data>, cat <blob_id>, adddir <dir_path>, getdir <root_id> <dest_path>, upload <key> <file_path>, download <key> <dest_path>, resume <transfer_id> [file_path], transfers, abort <transfer_id>, mpinit <key>, mpput <upload_id> <part_number> <file_path_or_data>, mpcomplete <upload_id>, mpabort <upload_id>, status, rotate-key, retire-key, quit")
 		}
 		
 		fmt.Print("> ")
@@ -172,6 +345,7 @@ func startCLI(s *FileServer) {
 }
 
 func handleStore(s *FileServer, key, pathOrData string) {
+	bucket, objKey := splitObjectName(key)
 	var reader io.Reader
 	var dataSize int64
 	
@@ -195,7 +369,7 @@ func handleStore(s *FileServer, key, pathOrData string) {
 		fmt.Printf("Storing data (%d bytes) with key '%s'...\n", dataSize, key)
 	}
 	
-	if err := s.Store(key, reader); err != nil {
+	if err := s.Store(bucket, objKey, reader); err != nil {
 		fmt.Printf("Error storing: %v\n", err)
 	} else {
 		fmt.Printf("Successfully stored '%s'\n", key)
@@ -203,11 +377,12 @@ func handleStore(s *FileServer, key, pathOrData string) {
 }
 
 func handleGet(s *FileServer, key string) {
-	reader, err := s.Get(key)
+	reader, err := s.Get(splitObjectName(key))
 	if err != nil {
 		fmt.Printf("Error getting file: %v\n", err)
 		return
 	}
+	defer reader.Close()
 	
 	data, err := io.ReadAll(reader)
 	if err != nil {
@@ -218,14 +393,370 @@ func handleGet(s *FileServer, key string) {
 	fmt.Printf("Retrieved '%s': %s\n", key, string(data))
 }
 
+func handleGetRange(s *FileServer, key string, offset, length int64) {
+	bucket, name := splitObjectName(key)
+	reader, err := s.GetRange(bucket, name, offset, length)
+	if err != nil {
+		fmt.Printf("Error getting range: %v\n", err)
+		return
+	}
+	
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		fmt.Printf("Error reading range: %v\n", err)
+		return
+	}
+	
+	fmt.Printf("Retrieved %d bytes of '%s' at %d: %s\n", len(data), key, offset, string(data))
+}
+
+func handleGetStream(s *FileServer, key string, cache bool) {
+	bucket, name := splitObjectName(key)
+	reader, err := s.GetStream(bucket, name, GetOpts{Cache: cache})
+	if err != nil {
+		fmt.Printf("Error getting file: %v\n", err)
+		return
+	}
+	defer reader.Close()
+	
+	fmt.Printf("Retrieved '%s': ", key)
+	if _, err := io.Copy(os.Stdout, reader); err != nil {
+		fmt.Printf("\nError reading file: %v\n", err)
+		return
+	}
+	fmt.Println()
+}
+
+func handlePutBlob(s *FileServer, pathOrData string) {
+	var reader io.Reader = bytes.NewReader([]byte(pathOrData))
+	if fileInfo, err := os.Stat(pathOrData); err == nil && !fileInfo.IsDir() {
+		file, err := os.Open(pathOrData)
+		if err != nil {
+			fmt.Printf("Error opening file '%s': %v\n", pathOrData, err)
+			return
+		}
+		defer file.Close()
+		reader = file
+	}
+	
+	cid, err := s.PutBlob(reader)
+	if err != nil {
+		fmt.Printf("Error storing blob: %v\n", err)
+		return
+	}
+	fmt.Printf("Stored blob %s\n", cid)
+}
+
+func handleGetBlob(s *FileServer, cid string) {
+	reader, err := s.GetBlob(cid)
+	if err != nil {
+		fmt.Printf("Error getting blob: %v\n", err)
+		return
+	}
+	
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		fmt.Printf("Error reading blob: %v\n", err)
+		return
+	}
+	
+	fmt.Printf("Retrieved blob %s: %s\n", cid, string(data))
+}
+
+func handleUpload(s *FileServer, key, path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("Error opening file '%s': %v\n", path, err)
+		return
+	}
+	defer file.Close()
+	
+	bucket, name := splitObjectName(key)
+	id, err := s.StoreResumable(bucket, name, file, ObjectOpts{})
+	if err != nil {
+		fmt.Printf("Error uploading file: %v\n", err)
+		if id != "" {
+			fmt.Printf("Resume with: resume %s %s\n", id, path)
+		}
+		return
+	}
+	fmt.Printf("Uploaded '%s' as '%s'\n", path, key)
+}
+
+func handleDownload(s *FileServer, key, path string) {
+	bucket, name := splitObjectName(key)
+	id, err := s.Download(bucket, name, path)
+	if err != nil {
+		fmt.Printf("Error downloading file: %v\n", err)
+		if id != "" {
+			fmt.Printf("Resume with: resume %s\n", id)
+		}
+		return
+	}
+	fmt.Printf("Downloaded '%s' to '%s'\n", key, path)
+}
+
+func handleResume(s *FileServer, id string, args []string) {
+	t, ok := s.transfers.Get(id)
+	if !ok {
+		fmt.Printf("Unknown transfer: %s\n", id)
+		return
+	}
+	
+	var err error
+	if t.Kind == TransferUpload {
+		if len(args) == 0 {
+			fmt.Println("Usage: resume <transfer_id> <file_path>")
+			return
+		}
+		file, ferr := os.Open(args[0])
+		if ferr != nil {
+			fmt.Printf("Error opening file '%s': %v\n", args[0], ferr)
+			return
+		}
+		defer file.Close()
+		err = s.ResumeUpload(id, file)
+	} else {
+		err = s.ResumeDownload(id)
+	}
+	if err != nil {
+		fmt.Printf("Error resuming transfer: %v\n", err)
+		return
+	}
+	fmt.Printf("Finished %s of '%s'\n", t.Kind, t.Key)
+}
+
+func handleTransfers(s *FileServer) {
+	transfers := s.Transfers()
+	for _, t := range transfers {
+		fmt.Printf("%s  %-8s  %s/%s  %d bytes done  %s\n", t.ID, t.Kind, t.Bucket, t.Key, t.Offset, t.Updated.Format(time.RFC3339))
+	}
+	fmt.Printf("%d unfinished transfer(s)\n", len(transfers))
+}
+
+func handleAbort(s *FileServer, id string) {
+	if err := s.AbortTransfer(id); err != nil {
+		fmt.Printf("Error aborting transfer: %v\n", err)
+		return
+	}
+	fmt.Printf("Aborted transfer %s\n", id)
+}
+
+func handleInitiateUpload(s *FileServer, key string) {
+	bucket, name := splitObjectName(key)
+	id, err := s.InitiateUpload(bucket, name)
+	if err != nil {
+		fmt.Printf("Error initiating upload: %v\n", err)
+		return
+	}
+	fmt.Printf("Initiated upload %s of '%s'\n", id, key)
+}
+
+func handleUploadPart(s *FileServer, id string, n int, pathOrData string) {
+	var reader io.Reader = bytes.NewReader([]byte(pathOrData))
+	if fileInfo, err := os.Stat(pathOrData); err == nil && !fileInfo.IsDir() {
+		file, err := os.Open(pathOrData)
+		if err != nil {
+			fmt.Printf("Error opening file '%s': %v\n", pathOrData, err)
+			return
+		}
+		defer file.Close()
+		reader = file
+	}
+	
+	part, err := s.UploadPart(id, n, reader)
+	if err != nil {
+		fmt.Printf("Error uploading part: %v\n", err)
+		return
+	}
+	fmt.Printf("Uploaded part %d (%d bytes) checksum %s\n", part.Number, part.Size, part.Checksum)
+}
+
+// handleCompleteUpload completes an upload with every part uploaded to it.
+func handleCompleteUpload(s *FileServer, id string) {
+	parts, err := s.ListParts(id)
+	if err != nil {
+		fmt.Printf("Error listing parts: %v\n", err)
+		return
+	}
+	if err := s.CompleteUpload(id, parts); err != nil {
+		fmt.Printf("Error completing upload: %v\n", err)
+		return
+	}
+	fmt.Printf("Completed upload %s from %d part(s)\n", id, len(parts))
+}
+
+func handleAbortUpload(s *FileServer, id string) {
+	if err := s.AbortUpload(id); err != nil {
+		fmt.Printf("Error aborting upload: %v\n", err)
+		return
+	}
+	fmt.Printf("Aborted upload %s\n", id)
+}
+
+func handleAddDir(s *FileServer, path string) {
+	root, err := s.AddDir(path)
+	if err != nil {
+		fmt.Printf("Error adding directory: %v\n", err)
+		return
+	}
+	fmt.Printf("Added directory '%s' as %s\n", path, root)
+}
+
+func handleGetDir(s *FileServer, root, dest string) {
+	if err := s.GetDir(root, dest); err != nil {
+		fmt.Printf("Error getting directory: %v\n", err)
+		return
+	}
+	fmt.Printf("Retrieved directory %s into '%s'\n", root, dest)
+}
+
+func handleStatus(s *FileServer) {
+	status := s.Status()
+	fmt.Printf("Node %s, %d peer(s): %s\n", status.Addr, len(status.Peers), strings.Join(status.Peers, ", "))
+	fmt.Printf("Disk: %d key(s), %d bytes\n", status.Keys, status.Bytes)
+	
+	d := status.Dedup
+	fmt.Printf("Dedup: %d chunk(s), %d reference(s), %d logical / %d physical bytes, ratio %.2f\n", d.Chunks, d.Refs, d.Logical, d.Physical, d.Ratio())
+	
+	c := status.Cache
+	fmt.Printf("Cache: %d copies, %d / %d bytes, %d hit(s), %d miss(es), %d eviction(s), hit ratio %.2f\n", c.Entries, c.Bytes, c.Budget, c.Hits, c.Misses, c.Evictions, c.HitRatio())
+	
+	sc := status.Scrub
+	fmt.Printf("Scrub: %d / %d key(s) checked, %d pass(es), %d bytes read, %d corrupt, %d repaired\n", sc.Scanned, sc.Keys, sc.Passes, sc.Bytes, sc.Corrupt, sc.Repaired)
+
+	ro := status.Rotation
+	if ro.Started.IsZero() {
+		fmt.Printf("Key: %s\n", s.Keystore.Active().ID)
+		return
+	}
+	state := "running"
+	if !ro.Finished.IsZero() {
+		state = fmt.Sprintf("finished, holding key(s) %v", s.Keystore.IDs())
+	}
+	fmt.Printf("Key rotation to %s: %d / %d file(s) moved, %d failed, %d bytes read, %s\n", ro.Key, ro.Moved, ro.Files, ro.Failed, ro.Bytes, state)
+}
+
+func handleRotateKey(s *FileServer) {
+	id, err := s.RotateKey()
+	if err != nil {
+		fmt.Printf("Error rotating key: %v\n", err)
+		return
+	}
+	fmt.Printf("Rotating to key %s, see status for progress\n", id)
+}
+
+func handleRetireKey(s *FileServer) {
+	retired, err := s.RetireKeys()
+	if err != nil {
+		fmt.Printf("Error retiring keys: %v\n", err)
+		return
+	}
+	fmt.Printf("Retired key(s) %v, holding %v\n", retired, s.Keystore.IDs())
+}
+
 func handleDelete(s *FileServer, key string) {
-	if err := s.Delete(key); err != nil {
+	if err := s.Delete(splitObjectName(key)); err != nil {
 		fmt.Printf("Error deleting file: %v\n", err)
 	} else {
 		fmt.Printf("Successfully deleted '%s'\n", key)
 	}
 }
 
+func handleList(s *FileServer, prefix, cursor string, limit int) {
+	bucket, keyPrefix := splitObjectName(prefix)
+	infos, next, err := s.List(bucket, keyPrefix, cursor, limit)
+	if err != nil {
+		fmt.Printf("Error listing keys: %v\n", err)
+		return
+	}
+	
+	for _, info := range infos {
+		fmt.Printf("%-32s %10d  %s\n", info.Key, info.Size, info.ModTime.Format(time.RFC3339))
+	}
+	fmt.Printf("%d key(s)\n", len(infos))
+	if next != "" {
+		fmt.Printf("More keys available, continue with: ls %s %s %d\n", prefix, next, limit)
+	}
+}
+
+func handleMakeBucket(s *FileServer, name string, settings []string) {
+	cfg, ok := s.buckets.Get(name)
+	if !ok {
+		cfg = BucketConfig{Name: name, Encrypt: true}
+	}
+	
+	for _, setting := range settings {
+		k, v, _ := strings.Cut(setting, "=")
+		var err error
+		switch k {
+		case "rf":
+			cfg.ReplicationFactor, err = strconv.Atoi(v)
+		case "encrypt":
+			cfg.Encrypt, err = strconv.ParseBool(v)
+		case "convergent":
+			cfg.Convergent, err = strconv.ParseBool(v)
+		case "quota":
+			cfg.Quota, err = strconv.ParseInt(v, 10, 64)
+		case "retention":
+			cfg.Retention, err = time.ParseDuration(v)
+		case "ec":
+			// <data>+<parity>, 0+0 switches back to replication
+			d, p, _ := strings.Cut(v, "+")
+			if cfg.DataShards, err = strconv.Atoi(d); err == nil {
+				cfg.ParityShards, err = strconv.Atoi(p)
+			}
+		case "chunking":
+			cfg.Chunking = Chunking(v)
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+		if err != nil {
+			fmt.Printf("Invalid setting '%s': %v\n", setting, err)
+			return
+		}
+	}
+	
+	if err := s.PutBucket(cfg); err != nil {
+		fmt.Printf("Error saving bucket: %v\n", err)
+	} else {
+		fmt.Printf("Successfully saved bucket '%s'\n", name)
+	}
+}
+
+func handleBuckets(s *FileServer) {
+	for _, cfg := range s.Buckets() {
+		fmt.Printf("%-16s rf=%d encrypt=%v convergent=%v quota=%d retention=%s ec=%d+%d chunking=%s\n", cfg.Name, cfg.ReplicationFactor, cfg.Encrypt, cfg.Convergent, cfg.Quota, cfg.Retention, cfg.DataShards, cfg.ParityShards, cmp.Or(cfg.Chunking, ChunkingFixed))
+	}
+}
+
+// passphraseEnv names the environment variable holding the passphrase of the
+// keystore.
+const passphraseEnv = "DFS_PASSPHRASE"
+
+// keystorePath and keySource come from the command line, the keystore
+// defaults to the one in the storage root of the node.
+var (
+	keystorePath string
+	keySource    KeySource
+)
+
+// loadKeystore opens the keystore of the node storing below root. A node
+// does not start without a passphrase or key file, it would encrypt with a
+// key of its own that no peer holds and that is lost when it stops.
+func loadKeystore(root string) *Keystore {
+	if keySource.Passphrase == "" && keySource.KeyFile == "" {
+		log.Fatalf("no passphrase or key file given, set $%s or --keyfile=<path>", passphraseEnv)
+	}
+	path := cmp.Or(keystorePath, filepath.Join(root, DefaultKeystoreName))
+	ks, err := OpenKeystore(path, keySource)
+	if err != nil {
+		log.Fatalf("unable to open keystore %s: %s", path, err)
+	}
+	log.Printf("loaded keystore %s, active key %s\n", path, ks.Active().ID)
+	return ks
+}
+
 func makeServer(listenAddr string, nodes ...string) *FileServer {
 	tcpTransportOpts := p2p.TCPTransportOpts{
 		ListenAddress: listenAddr,
@@ -233,14 +764,17 @@ func makeServer(listenAddr string, nodes ...string) *FileServer {
 		Decoder:       p2p.DefaultDecoder{},
 	}
 	tcpTransport := p2p.NewTCPTransport(tcpTransportOpts)
+	root := listenAddr + "_network"
 	fileServerOpts := FileServerOpts{
-		EncKey:            newEncryptionKey(),
-		StorageRoot:       listenAddr + "_network",
+		Keystore:          loadKeystore(root),
+		StorageRoot:       root,
 		PathTransfromFunc: CASPathTransform,
 		Transport:         tcpTransport,
 		BootstrapNodes:    nodes,
 	}
 	s := NewFileServer(fileServerOpts)
+	tcpTransport.HandShakeFunc = s.Handshake
 	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerClose = s.OnPeerClose
 	return s
 }
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Multipart uploads store the parts of an object separately, each through any
+// node, and assemble them into the object in one step. The upload and the
+// manifest of every part are kept in the upload bucket, replicated like the
+// objects of the default bucket, so every node can serve them. The chunks of a
+// part are referenced by the part until the upload completes or is aborted.
+
+// uploadBucket holds the uploads and their parts. Like the chunk bucket its
+// name starts with a dot, which no bucket may be created with, so uploads stay
+// out of listings.
+const uploadBucket = ".uploads"
+
+// MaxParts is the highest part number of a multipart upload.
+const MaxParts = 10000
+
+// DefaultUploadTTL is how long an incomplete upload is kept when
+// FileServerOpts does not set UploadTTL.
+const DefaultUploadTTL = 24 * time.Hour
+
+// UploadGCInterval is how often a node looks for incomplete uploads to remove.
+var UploadGCInterval = 10 * time.Minute
+
+var (
+	ErrUnknownUpload = errors.New("unknown multipart upload")
+	ErrInvalidPart   = errors.New("invalid part")
+)
+
+// MultipartUpload is an upload initiated to store the object under Key.
+type MultipartUpload struct {
+	ID        string
+	Bucket    string
+	Key       string
+	Initiated time.Time
+}
+
+// Part is an uploaded part of a multipart upload. Checksum is the hex SHA-256
+// of its content.
+type Part struct {
+	Number   int
+	Size     int64
+	Checksum string
+}
+
+func uploadKey(id string) string {
+	return objectKey(uploadBucket, id)
+}
+
+func partKey(id string, n int) string {
+	return objectKey(uploadBucket, fmt.Sprintf("%s/%d", id, n))
+}
+
+// InitiateUpload starts a multipart upload of the object under key and
+// returns its ID, which UploadPart, CompleteUpload and AbortUpload take on
+// any node.
+func (s *FileServer) InitiateUpload(bucket, key string) (string, error) {
+	if _, err := s.bucket(bucket); err != nil {
+		return "", err
+	}
+	meta, err := s.bucket(DefaultBucket)
+	if err != nil {
+		return "", err
+	}
+
+	u := MultipartUpload{
+		ID:        newTransferID(),
+		Bucket:    bucket,
+		Key:       key,
+		Initiated: time.Now(),
+	}
+	b, err := json.Marshal(u)
+	if err != nil {
+		return "", err
+	}
+	k := uploadKey(u.ID)
+	if _, err := s.store.writeObject(k, k, int64(len(b)), bytes.NewReader(b)); err != nil {
+		return "", err
+	}
+	log.Printf("[%s] initiated upload %s of [%s]\n", s.Transport.ListenAddr(), u.ID, objectKey(bucket, key))
+	return u.ID, s.replicate(meta, k, int64(len(b)), b)
+}
+
+// multipartUpload returns upload id from wherever a copy of it is.
+func (s *FileServer) multipartUpload(meta BucketConfig, id string) (MultipartUpload, error) {
+	var u MultipartUpload
+	if id == "" || strings.Contains(id, "/") {
+		return u, fmt.Errorf("%w: %s", ErrUnknownUpload, id)
+	}
+	r, err := s.openCopy(meta, uploadKey(id))
+	if err != nil {
+		return u, fmt.Errorf("%w: %s", ErrUnknownUpload, id)
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(&u); err != nil {
+		return u, fmt.Errorf("corrupt upload %s: %w", id, err)
+	}
+	return u, nil
+}
+
+// UploadPart stores the content of r as part n of upload id. Parts may be
+// uploaded in any order, in parallel and through different nodes. Uploading
+// a part again replaces it.
+func (s *FileServer) UploadPart(id string, n int, r io.Reader) (Part, error) {
+	if n < 1 || n > MaxParts {
+		return Part{}, fmt.Errorf("%w: number %d not in 1..%d", ErrInvalidPart, n, MaxParts)
+	}
+	meta, err := s.bucket(DefaultBucket)
+	if err != nil {
+		return Part{}, err
+	}
+	u, err := s.multipartUpload(meta, id)
+	if err != nil {
+		return Part{}, err
+	}
+	cfg, err := s.bucket(u.Bucket)
+	if err != nil {
+		return Part{}, err
+	}
+	key := partKey(id, n)
+
+	old, replace := s.findManifest(meta, key)
+	hold := pendingRef()
+	manifest, err := s.storeChunks(cfg, s.chunker(cfg.Chunking, r), old, hold)
+	// the chunks stay if the part references them
+	defer s.release(hold, manifest)
+	if err != nil {
+		return Part{}, err
+	}
+	b, err := encodeManifest(manifest)
+	if err != nil {
+		return Part{}, err
+	}
+	if _, err := s.store.writeObject(key, key, manifest.Size, bytes.NewReader(b)); err != nil {
+		return Part{}, err
+	}
+	if err := s.retain(key, manifest); err != nil {
+		return Part{}, err
+	}
+	if replace {
+		if err := s.releaseStale(key, old, manifest); err != nil {
+			return Part{}, err
+		}
+	}
+	if err := s.replicate(meta, key, manifest.Size, b); err != nil {
+		return Part{}, err
+	}
+
+	log.Printf("[%s] stored part %d of upload %s, %d bytes\n", s.Transport.ListenAddr(), n, id, manifest.Size)
+	return Part{Number: n, Size: manifest.Size, Checksum: manifest.Checksum}, nil
+}
+
+// ListParts returns the parts uploaded to upload id so far, by number.
+func (s *FileServer) ListParts(id string) ([]Part, error) {
+	meta, err := s.bucket(DefaultBucket)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.multipartUpload(meta, id); err != nil {
+		return nil, err
+	}
+	numbers, err := s.partNumbers(id)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]Part, 0, len(numbers))
+	for _, n := range numbers {
+		m, ok := s.findManifest(meta, partKey(id, n))
+		if !ok {
+			continue
+		}
+		parts = append(parts, Part{Number: n, Size: m.Size, Checksum: m.Checksum})
+	}
+	return parts, nil
+}
+
+// partNumbers lists the numbers of the parts of upload id held anywhere in
+// the cluster, in order.
+func (s *FileServer) partNumbers(id string) ([]int, error) {
+	prefix := objectKey(uploadBucket, id+"/")
+	infos, err := s.listKeys(prefix, "", MaxParts)
+	if err != nil {
+		return nil, err
+	}
+
+	var numbers []int
+	for _, info := range infos {
+		n, err := strconv.Atoi(strings.TrimPrefix(info.Key, prefix))
+		if err != nil {
+			continue
+		}
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
+
+// CompleteUpload assembles the object of upload id from parts, which must be
+// in ascending order and match what was uploaded. The object is committed in
+// a single step, readers see either the version it replaces or the whole new
+// one. Parts left out are discarded along with the upload.
+func (s *FileServer) CompleteUpload(id string, parts []Part) error {
+	meta, err := s.bucket(DefaultBucket)
+	if err != nil {
+		return err
+	}
+	u, err := s.multipartUpload(meta, id)
+	if err != nil {
+		return err
+	}
+	cfg, err := s.bucket(u.Bucket)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return fmt.Errorf("%w: upload %s has no parts to complete", ErrInvalidPart, id)
+	}
+
+	// the parts only name their chunks, which are stored already
+	manifest := newManifest(cfg)
+	for i, p := range parts {
+		if i > 0 && p.Number <= parts[i-1].Number {
+			return fmt.Errorf("%w: part %d follows part %d", ErrInvalidPart, p.Number, parts[i-1].Number)
+		}
+		m, ok := s.findManifest(meta, partKey(id, p.Number))
+		if !ok {
+			return fmt.Errorf("%w: part %d of upload %s was not uploaded", ErrInvalidPart, p.Number, id)
+		}
+		if m.Checksum != p.Checksum {
+			return fmt.Errorf("%w: part %d of upload %s has checksum [%s]", ErrInvalidPart, p.Number, id, m.Checksum)
+		}
+		if m.Encrypted != manifest.Encrypted || m.Convergent != manifest.Convergent || m.DataShards != manifest.DataShards || m.ParityShards != manifest.ParityShards {
+			return fmt.Errorf("%w: part %d was stored before bucket [%s] changed", ErrInvalidPart, p.Number, u.Bucket)
+		}
+		manifest.Chunks = append(manifest.Chunks, m.Chunks...)
+		manifest.Size += m.Size
+	}
+
+	if err := s.commitObject(cfg, u.Bucket, objectKey(u.Bucket, u.Key), manifest); err != nil {
+		return err
+	}
+	return s.clearUpload(meta, id)
+}
+
+// AbortUpload discards upload id and every part uploaded to it.
+func (s *FileServer) AbortUpload(id string) error {
+	meta, err := s.bucket(DefaultBucket)
+	if err != nil {
+		return err
+	}
+	if _, err := s.multipartUpload(meta, id); err != nil {
+		return err
+	}
+	return s.clearUpload(meta, id)
+}
+
+// clearUpload releases the chunks of the parts of upload id and deletes the
+// parts and the upload on every node.
+func (s *FileServer) clearUpload(meta BucketConfig, id string) error {
+	numbers, err := s.partNumbers(id)
+	if err != nil {
+		return err
+	}
+	for _, n := range numbers {
+		key := partKey(id, n)
+		if m, ok := s.findManifest(meta, key); ok {
+			if err := s.release(key, m); err != nil {
+				return err
+			}
+		}
+		if err := s.purge(key); err != nil {
+			return err
+		}
+	}
+	return s.purge(uploadKey(id))
+}
+
+// findManifest returns the manifest of key from wherever a copy of it is,
+// without keeping one on this node.
+func (s *FileServer) findManifest(cfg BucketConfig, key string) (Manifest, bool) {
+	r, err := s.openCopy(cfg, key)
+	if err != nil {
+		return Manifest{}, false
+	}
+	defer r.Close()
+
+	m, ok, _, err := readManifest(r)
+	return m, ok && err == nil
+}
+
+// purge deletes key on every node, the copy stored by the node that wrote it
+// as well as the replicas.
+func (s *FileServer) purge(key string) error {
+	for _, k := range []string{key, hashKey(key)} {
+		if s.store.Has(k) {
+			if err := s.store.Delete(k); err != nil {
+				return err
+			}
+		}
+		msg := Message{
+			Payload: MessageFileKey{
+				Key:    k,
+				Action: ACTION_DELETE,
+			},
+		}
+		if err := s.broadCast(&msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileServer) uploadGCLoop() {
+	ticker := time.NewTicker(UploadGCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.expireUploads()
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// expireUploads deletes the local copies of uploads and parts older than the
+// UploadTTL and releases the chunks of the parts. Every node expires its own
+// copies, so uploads that were never completed nor aborted do not hold on to
+// their chunks forever.
+func (s *FileServer) expireUploads() {
+	meta, err := s.bucket(DefaultBucket)
+	if err != nil {
+		return
+	}
+	deadline := time.Now().Add(-cmp.Or(s.UploadTTL, DefaultUploadTTL))
+	for _, entry := range s.store.index.Entries(objectKey(uploadBucket, "")) {
+		if entry.ModTime.After(deadline) {
+			continue
+		}
+		log.Printf("[%s] expiring [%s] of an incomplete upload\n", s.Transport.ListenAddr(), entry.Name)
+		manifest, ok := s.findManifest(meta, entry.Name)
+		if err := s.store.Delete(entry.Key); err != nil {
+			log.Printf("unable to expire [%s]: %s\n", entry.Name, err)
+			continue
+		}
+		if ok {
+			s.release(entry.Name, manifest)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMultipartUpload(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	id, err := s.InitiateUpload(DefaultBucket, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := []string{"the first part of a document, ", "then the second ", "and the last"}
+	parts := make([]Part, len(contents))
+	var wg sync.WaitGroup
+	for i := len(contents) - 1; i >= 0; i-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			part, err := s.UploadPart(id, i+1, strings.NewReader(contents[i]))
+			if err != nil {
+				t.Error(err)
+			}
+			parts[i] = part
+		}()
+	}
+	wg.Wait()
+
+	if listed, err := s.ListParts(id); err != nil || len(listed) != len(parts) || listed[0] != parts[0] {
+		t.Fatalf("have parts %+v %v want %+v", listed, err, parts)
+	}
+	if err := s.CompleteUpload(id, []Part{parts[1], parts[0]}); !errors.Is(err, ErrInvalidPart) {
+		t.Errorf("have %v want %v for parts out of order", err, ErrInvalidPart)
+	}
+	if err := s.CompleteUpload(id, parts); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s.Get(DefaultBucket, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := io.ReadAll(r); string(out) != strings.Join(contents, "") {
+		t.Errorf("have %q want %q", out, strings.Join(contents, ""))
+	}
+	if len(s.store.index.Entries(objectKey(uploadBucket, ""))) != 0 {
+		t.Error("expected the upload and its parts to be deleted")
+	}
+	if stats := s.DedupStats(); stats.Refs != stats.Chunks {
+		t.Errorf("have %d refs to %d chunks, want the part references released", stats.Refs, stats.Chunks)
+	}
+	if _, err := s.UploadPart(id, 1, strings.NewReader("late")); !errors.Is(err, ErrUnknownUpload) {
+		t.Errorf("have %v want %v", err, ErrUnknownUpload)
+	}
+}
+
+func TestAbortUpload(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	id, err := s.InitiateUpload(DefaultBucket, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UploadPart(id, 1, bytes.NewReader([]byte("a part that is never completed"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AbortUpload(id); err != nil {
+		t.Fatal(err)
+	}
+	if stats := s.DedupStats(); stats.Chunks != 0 {
+		t.Errorf("have %d chunks want the chunks of the part deleted", stats.Chunks)
+	}
+	if _, err := s.ListParts(id); !errors.Is(err, ErrUnknownUpload) {
+		t.Errorf("have %v want %v", err, ErrUnknownUpload)
+	}
+}
+
+func TestExpireUploads(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	id, err := s.InitiateUpload(DefaultBucket, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UploadPart(id, 1, bytes.NewReader([]byte("a part that is forgotten"))); err != nil {
+		t.Fatal(err)
+	}
+
+	s.expireUploads()
+	if len(s.store.index.Entries(objectKey(uploadBucket, ""))) != 2 {
+		t.Fatal("expected a fresh upload to be kept")
+	}
+
+	s.UploadTTL = time.Nanosecond
+	s.expireUploads()
+	if len(s.store.index.Entries(objectKey(uploadBucket, ""))) != 0 {
+		t.Error("expected the upload and its part to expire")
+	}
+	if stats := s.DedupStats(); stats.Chunks != 0 {
+		t.Errorf("have %d chunks want the chunks of the part deleted", stats.Chunks)
+	}
+}
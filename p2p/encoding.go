@@ -1,6 +1,7 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
 	"io"
 	"log"
@@ -31,12 +32,35 @@ func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
 		log.Println("this is a stream connection. decoding avoided...")
 		return nil
 	}
+	msg.Stream = peekBuf[0] == IncomingMessageStream
 
-	buf := make([]byte, 1024)
-	n, err := r.Read(buf)
-	if err != nil {
+	// messages are length prefixed, see EncodeMessage
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
 		return err
 	}
-	msg.Payload = buf[:n]
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	msg.Payload = buf
 	return nil
 }
+
+// EncodeMessage frames payload as an IncomingMessage, so that the decoder can
+// tell where it ends even when several messages arrive back to back.
+func EncodeMessage(payload []byte) []byte {
+	return encodeFrame(IncomingMessage, payload)
+}
+
+// EncodeStreamMessage frames payload as an IncomingMessageStream.
+func EncodeStreamMessage(payload []byte) []byte {
+	return encodeFrame(IncomingMessageStream, payload)
+}
+
+func encodeFrame(kind byte, payload []byte) []byte {
+	buf := make([]byte, 5, 5+len(payload))
+	buf[0] = kind
+	binary.LittleEndian.PutUint32(buf[1:], uint32(len(payload)))
+	return append(buf, payload...)
+}
@@ -5,10 +5,19 @@ import "net"
 const (
 	IncomingMessage = 0x1
 	IncomingStream  = 0x2
+
+	// IncomingMessageStream is a message directly followed by a stream. The
+	// receiver reads the stream while handling the message and calls
+	// CloseStream once done, no other reads happen on the connection meanwhile.
+	IncomingMessageStream = 0x3
 )
 
 type RPC struct {
 	From    net.Addr
 	Payload []byte
 	Stream  bool
+
+	// Peer sent the message. The stream following a message is read from it
+	// and closed with its CloseStream.
+	Peer Peer
 }
@@ -1,6 +1,7 @@
 package p2p
 
 import (
+	"io"
 	"log"
 	"net"
 	"sync"
@@ -15,20 +16,78 @@ type TCPPeer struct {
 	// if we accept and retrive a conn => outbound == false
 	outbound bool
 
-	wg *sync.WaitGroup
+	// the read loop hands incoming streams over through streamch and waits
+	// on closech until the reader is done with the connection, donech is
+	// closed once the read loop exited
+	streamch chan struct{}
+	closech  chan struct{}
+	donech   chan struct{}
+
+	// wmu keeps what Send and SendStream write together
+	wmu sync.Mutex
+}
+
+// AwaitStream blocks until the read loop consumed an IncomingStream marker.
+// The caller then reads the stream and must call CloseStream afterwards.
+func (peer *TCPPeer) AwaitStream() error {
+	select {
+	case <-peer.streamch:
+		return nil
+	case <-peer.donech:
+		return ErrPeerClosed
+	}
 }
 
 func (peer *TCPPeer) CloseStream() {
-	peer.wg.Done()
+	select {
+	case peer.closech <- struct{}{}:
+	case <-peer.donech:
+	}
 }
 
+// Send writes b in a single write, writes of other goroutines on the same
+// connection never land in the middle of it.
 func (peer *TCPPeer) Send(b []byte) error {
+	peer.wmu.Lock()
+	defer peer.wmu.Unlock()
 	_, err := peer.Conn.Write(b)
 	return err
 }
 
+// SendStream writes head followed by n bytes of r without holding them in
+// memory, writes of other goroutines on the same connection never land in
+// the middle of it. The connection is closed if r ends before n bytes, the
+// other side would wait for the rest forever.
+func (peer *TCPPeer) SendStream(head []byte, r io.Reader, n int64) error {
+	peer.wmu.Lock()
+	defer peer.wmu.Unlock()
+	if _, err := peer.Conn.Write(head); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(peer.Conn, r, n); err != nil {
+		peer.Conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (peer *TCPPeer) SendMessage(payload []byte) error {
+	return peer.Send(EncodeMessage(payload))
+}
+
+// SendStreamMessage sends payload directly followed by stream.
+func (peer *TCPPeer) SendStreamMessage(payload, stream []byte) error {
+	return peer.Send(append(EncodeStreamMessage(payload), stream...))
+}
+
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
-	return &TCPPeer{Conn: conn, outbound: outbound, wg: &sync.WaitGroup{}}
+	return &TCPPeer{
+		Conn:     conn,
+		outbound: outbound,
+		streamch: make(chan struct{}),
+		closech:  make(chan struct{}),
+		donech:   make(chan struct{}),
+	}
 }
 
 type TCPTransportOpts struct {
@@ -36,6 +95,7 @@ type TCPTransportOpts struct {
 	HandShakeFunc HandShakeFunc
 	Decoder       Decoder
 	OnPeer        func(Peer, bool) error
+	OnPeerClose   func(Peer)
 }
 
 type TCPTransport struct {
@@ -107,6 +167,8 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 
 	var err error
 
+	peer := NewTCPPeer(conn, outbound)
+
 	defer func() {
 		if err != nil {
 			log.Printf("dropping peer connection %s: %v\n", conn.RemoteAddr(), err)
@@ -114,10 +176,12 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 			log.Printf("peer connection %s closed gracefully\n", conn.RemoteAddr())
 		}
 		conn.Close()
+		close(peer.donech)
+		if t.OnPeerClose != nil {
+			t.OnPeerClose(peer)
+		}
 	}()
 
-	peer := NewTCPPeer(conn, outbound)
-
 	if err = t.HandShakeFunc(peer); err != nil {
 		log.Printf("handshake failed with %s: %v\n", conn.RemoteAddr(), err)
 		return
@@ -134,6 +198,7 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 	for {
 		rpc := RPC{}
 		rpc.From = conn.RemoteAddr() // Use RemoteAddr for better identification
+		rpc.Peer = peer
 
 		if err = t.Decoder.Decode(conn, &rpc); err != nil {
 			log.Printf("decode error from %s: %v\n", conn.RemoteAddr(), err)
@@ -143,9 +208,14 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 		log.Printf("decoded message from %s: stream=%v\n", conn.RemoteAddr(), rpc.Stream)
 
 		if rpc.Stream {
-			peer.wg.Add(1)
+			if rpc.Payload != nil {
+				// the handler of the message reads the stream
+				t.rpcch <- rpc
+			} else {
+				peer.streamch <- struct{}{}
+			}
 			log.Printf("[%s] incoming stream, waiting...\n", conn.RemoteAddr())
-			peer.wg.Wait()
+			<-peer.closech
 			log.Printf("[%s] stream closed, resuming read loop\n", conn.RemoteAddr())
 			continue
 		}
@@ -1,6 +1,9 @@
 package p2p
 
 import (
+	"bytes"
+	"io"
+	"net"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -18,3 +21,59 @@ func TestTCPTransport(t *testing.T) {
 	// Server
 	assert.Nil(t, tr.ListenAndAccept())
 }
+
+func TestDefaultDecoderFraming(t *testing.T) {
+	buf := new(bytes.Buffer)
+	buf.Write(EncodeMessage([]byte("first")))
+	buf.Write(EncodeMessage([]byte("second")))
+	buf.Write(EncodeStreamMessage([]byte("third")))
+	buf.WriteByte(IncomingStream)
+
+	dec := DefaultDecoder{}
+	for _, want := range []string{"first", "second", "third"} {
+		var rpc RPC
+		assert.Nil(t, dec.Decode(buf, &rpc))
+		assert.Equal(t, want, string(rpc.Payload))
+		assert.Equal(t, want == "third", rpc.Stream)
+	}
+
+	var rpc RPC
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.True(t, rpc.Stream)
+	assert.Nil(t, rpc.Payload)
+}
+
+func TestSendStream(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	other, err := ln.Accept()
+	assert.Nil(t, err)
+	defer other.Close()
+	peer := NewTCPPeer(conn, true)
+
+	// sends of other goroutines never land inside the stream
+	body := bytes.Repeat([]byte("b"), 1<<20)
+	done := make(chan error)
+	go func() { done <- peer.SendStream([]byte("head"), bytes.NewReader(body), int64(len(body))) }()
+	go func() { done <- peer.Send([]byte("x")) }()
+
+	got := make([]byte, 4+len(body)+1)
+	_, err = io.ReadFull(other, got)
+	assert.Nil(t, err)
+	assert.Nil(t, <-done)
+	assert.Nil(t, <-done)
+	if got[0] == 'x' {
+		got = got[1:]
+	}
+	assert.Equal(t, "head", string(got[:4]))
+	assert.True(t, bytes.Equal(body, got[4:4+len(body)]))
+
+	// a stream shorter than announced closes the connection
+	assert.NotNil(t, peer.SendStream(nil, bytes.NewReader(body[:10]), 20))
+	_, err = io.ReadAll(other)
+	assert.Nil(t, err)
+}
@@ -1,13 +1,21 @@
 package p2p
 
 import (
+	"errors"
+	"io"
 	"net"
 )
 
+var ErrPeerClosed = errors.New("peer connection closed")
+
 type Peer interface {
 	// Conn() net.Conn
 	net.Conn
 	Send([]byte) error
+	SendStream(head []byte, r io.Reader, n int64) error
+	SendMessage([]byte) error
+	SendStreamMessage(payload, stream []byte) error
+	AwaitStream() error
 	CloseStream()
 }
 
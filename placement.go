@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/vasanthgk02/distributed_file_system/p2p"
+)
+
+// placePeers picks the n peers responsible for key using rendezvous hashing,
+// so that a key keeps most of its peers when others join or leave. n <= 0 or
+// n beyond the number of peers returns every peer.
+func (s *FileServer) placePeers(key string, n int) []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	type ranked struct {
+		weight uint64
+		peer   p2p.Peer
+	}
+	peers := make([]ranked, 0, len(s.peers))
+	for addr, peer := range s.peers {
+		peers = append(peers, ranked{weight: placementWeight(addr, key), peer: peer})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].weight > peers[j].weight })
+
+	if n <= 0 || n > len(peers) {
+		n = len(peers)
+	}
+	placed := make([]p2p.Peer, n)
+	for i := range placed {
+		placed[i] = peers[i].peer
+	}
+	return placed
+}
+
+// ErrTooFewPeers is returned when a chunk has more shards than there are
+// peers to place them on.
+var ErrTooFewPeers = errors.New("too few peers")
+
+// placeShards picks a distinct peer for each of n shards of key. A peer
+// holding two shards would lose both at once, so fewer than n peers is an
+// error.
+func (s *FileServer) placeShards(key string, n int) ([]p2p.Peer, error) {
+	peers := s.placePeers(key, 0)
+	if len(peers) < n {
+		return nil, fmt.Errorf("%w: %d shards of [%s] on %d peer(s)", ErrTooFewPeers, n, key, len(peers))
+	}
+	return peers[:n], nil
+}
+
+func placementWeight(addr, key string) uint64 {
+	hash := sha256.Sum256([]byte(addr + "/" + key))
+	return binary.BigEndian.Uint64(hash[:8])
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/vasanthgk02/distributed_file_system/p2p"
+)
+
+var ErrInvalidRange = errors.New("invalid range")
+
+// MessageGetRange asks a peer for Length bytes of its copy of Key starting at
+// Offset. Encrypted copies are answered with the header of their encryption
+// followed by the segments holding the range, which the requester decrypts.
+// The reply is the length of what follows, FILE_NOT_FOUND if the peer does
+// not hold Key.
+type MessageGetRange struct {
+	Key       string
+	Offset    int64
+	Length    int64
+	Encrypted bool
+}
+
+// GetRange returns length bytes of the object under key starting at offset,
+// fewer if the object ends before. Only the chunks covering the range are
+// read, and only the requested slices of them travel over the network. The
+// chunks are not written to local disk, except for erasure coded chunks,
+// which have to be rebuilt whole.
+func (s *FileServer) GetRange(bucket, key string, offset, length int64) (io.Reader, error) {
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("%w: %d bytes at %d", ErrInvalidRange, length, offset)
+	}
+	cfg, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	key = objectKey(bucket, key)
+
+	s.account(key)
+	if !s.store.Has(key) {
+		if err := s.fetch(cfg, key); err != nil {
+			return nil, err
+		}
+		s.cacheFetched(key)
+	}
+	_, r, err := s.store.readStream(key)
+	if err != nil {
+		return nil, err
+	}
+	manifest, ok, _, err := readManifest(r)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// objects stored before chunking are whole on disk
+		b, err := s.store.readSection(key, offset, length)
+		return bytes.NewReader(b), err
+	}
+
+	rr := &rangeReader{s: s, cfg: cfg, manifest: manifest}
+	end := min(offset+length, manifest.Size)
+	var pos int64
+	for _, ref := range manifest.Chunks {
+		start, stop := max(offset, pos), min(end, pos+ref.Size)
+		if start < stop {
+			rr.parts = append(rr.parts, rangePart{ref: ref, offset: start - pos, length: stop - start})
+		}
+		pos += ref.Size
+	}
+	return rr, nil
+}
+
+// rangePart is the slice of a chunk a range covers.
+type rangePart struct {
+	ref            ChunkRef
+	offset, length int64
+}
+
+// rangeReader reads the parts of a range in order, one chunk at a time.
+type rangeReader struct {
+	s        *FileServer
+	cfg      BucketConfig
+	manifest Manifest
+	parts    []rangePart
+	cur      *bytes.Reader
+}
+
+func (r *rangeReader) Read(b []byte) (int, error) {
+	for r.cur == nil || r.cur.Len() == 0 {
+		if len(r.parts) == 0 {
+			return 0, io.EOF
+		}
+		part := r.parts[0]
+		r.parts = r.parts[1:]
+
+		key := r.manifest.chunkKey(part.ref.ID)
+		r.s.account(key)
+		if r.manifest.ErasureCoded() && !r.s.store.Has(key) {
+			if err := r.s.fetchChunk(r.cfg, r.manifest, part.ref); err != nil {
+				return 0, err
+			}
+		}
+		data, err := r.s.readRange(r.cfg, key, part.offset, part.length)
+		if err != nil {
+			return 0, err
+		}
+		r.cur = bytes.NewReader(data)
+	}
+	return r.cur.Read(b)
+}
+
+// readRange reads length bytes of key from offset out of the local store, the
+// replica of this node or the replica of a peer, in that order.
+func (s *FileServer) readRange(cfg BucketConfig, key string, offset, length int64) ([]byte, error) {
+	if s.store.Has(key) {
+		return s.store.readSection(key, offset, length)
+	}
+	if s.store.Has(hashKey(key)) {
+		raw, err := s.store.copySection(hashKey(key), offset, length, cfg.Encrypt)
+		if err == nil {
+			return s.openSection(raw, offset, length, cfg.Encrypt)
+		}
+	}
+
+	// the peers placed for key rank first
+	for _, peer := range s.placePeers(key, 0) {
+		raw, err := s.rangeFrom(peer, cfg, key, offset, length)
+		if err != nil {
+			log.Printf("[%s] range of [%s] unavailable on [%s]: %s\n", s.Transport.ListenAddr(), key, peer.RemoteAddr(), err)
+			continue
+		}
+		return s.openSection(raw, offset, length, cfg.Encrypt)
+	}
+	return nil, fmt.Errorf("range of [%s] does not exist in network", key)
+}
+
+func (s *FileServer) rangeFrom(peer p2p.Peer, cfg BucketConfig, key string, offset, length int64) ([]byte, error) {
+	msg := Message{
+		Payload: MessageGetRange{
+			Key:       hashKey(key),
+			Offset:    offset,
+			Length:    length,
+			Encrypted: cfg.Encrypt,
+		},
+	}
+	var raw []byte
+	found := false
+	err := s.collectFrom([]p2p.Peer{peer}, &msg, func(peer p2p.Peer) error {
+		var size int64
+		if err := binary.Read(peer, binary.LittleEndian, &size); err != nil {
+			return err
+		}
+		if size == FILE_NOT_FOUND {
+			return nil
+		}
+		found = true
+		raw = make([]byte, size)
+		_, err := io.ReadFull(peer, raw)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("peer does not hold [%s]", key)
+	}
+	return raw, nil
+}
+
+// copySection returns the bytes a range of key takes in a copy: for an
+// encrypted copy, its header and the segments holding the range.
+func (s *Store) copySection(key string, offset, length int64, encrypted bool) ([]byte, error) {
+	if !encrypted {
+		return s.readSection(key, offset, length)
+	}
+	head, err := s.readSection(key, 0, int64(encHeaderSize))
+	if err != nil {
+		return nil, err
+	}
+	header, start, n, err := encryptedSection(head, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.readSection(key, start, n)
+	return append(bytes.Clone(header), data...), err
+}
+
+// openSection decrypts what copySection returned for a range from offset.
+func (s *FileServer) openSection(raw []byte, offset, length int64, encrypted bool) ([]byte, error) {
+	if !encrypted {
+		return raw, nil
+	}
+	return decryptSection(s.Keystore, raw, offset, length)
+}
+
+func (s *FileServer) handleMessageGetRange(from string, msg MessageGetRange) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer [%s] does not exist in peer map", from)
+	}
+
+	raw, err := s.store.copySection(msg.Key, msg.Offset, msg.Length, msg.Encrypted)
+	if err != nil {
+		return replyNotFound(peer)
+	}
+	return reply(peer, binary.LittleEndian.AppendUint64(nil, uint64(len(raw))), raw)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestGetRange(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	data := []byte("ranges cross the boundaries of 8 byte chunks")
+	if err := s.Store(DefaultBucket, "doc", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ offset, length int64 }{
+		{0, 8}, {3, 10}, {5, 30}, {40, 100}, {int64(len(data)), 4}, {100, 4}, {7, 0},
+	} {
+		r, err := s.GetRange(DefaultBucket, "doc", tc.offset, tc.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := min(tc.offset, int64(len(data)))
+		want := data[start:min(start+tc.length, int64(len(data)))]
+		if !bytes.Equal(out, want) {
+			t.Errorf("range %d+%d: have %q want %q", tc.offset, tc.length, out, want)
+		}
+	}
+
+	if _, err := s.GetRange(DefaultBucket, "doc", -1, 4); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("have %v want %v", err, ErrInvalidRange)
+	}
+}
+
+func TestReadRangeEncrypted(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 8)
+	enc := new(bytes.Buffer)
+	if _, err := copyEncrypt(s.Keystore.Active(), bytes.NewReader(data), enc); err != nil {
+		t.Fatal(err)
+	}
+	key := Manifest{Encrypted: true}.chunkKey("encrypted")
+	if _, err := s.store.writeObject(hashKey(key), key, int64(len(data)), enc); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := s.readRange(BucketConfig{Encrypt: true}, key, 21, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data[21:71]) {
+		t.Errorf("have %q want %q", out, data[21:71])
+	}
+}
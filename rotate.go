@@ -0,0 +1,233 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Rotating the master key makes a new key the active one on every node and
+// moves the encrypted files of each node to it in the background, no faster
+// than RotateRate. The new key travels to the peers wrapped under the key it
+// replaces, which the whole cluster shares. A file with a data key only has
+// its header rewrapped, older files are encrypted again. Files are picked by
+// the key the index records for them. A node that stops before it moved them
+// all resumes when it starts again. Older keys are only dropped by RetireKeys,
+// on every node, and each node keeps those any of its files still records.
+
+// DefaultRotateRate is the bytes per second a rotation reads when
+// FileServerOpts does not set RotateRate.
+const DefaultRotateRate int64 = 4 << 20
+
+// RotationStats reports the progress of the last key rotation of a node.
+type RotationStats struct {
+	Key      string    // ID of the key files are moved to, empty before any rotation
+	Files    int       // encrypted files to move
+	Moved    int       // files moved to the key
+	Failed   int       // files left under an older key
+	Bytes    int64     // bytes read
+	Started  time.Time // zero before any rotation
+	Finished time.Time // zero while the rotation runs
+}
+
+// MessageRotateKey hands the peers Key, the new master key, wrapped under the
+// master key By.
+type MessageRotateKey struct {
+	By  string
+	Key wrappedKey
+}
+
+// MessageRetireKeys asks the peers to retire the master keys none of their
+// files records anymore.
+type MessageRetireKeys struct{}
+
+type rotator struct {
+	mu    sync.Mutex
+	gen   int // of the rotation running, a newer one stops it
+	stats RotationStats
+}
+
+// update applies fn to the stats of rotation gen, unless a newer rotation
+// replaced it.
+func (ro *rotator) update(gen int, fn func(*RotationStats)) bool {
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	if gen != ro.gen {
+		return false
+	}
+	fn(&ro.stats)
+	return true
+}
+
+func (s *FileServer) RotationStats() RotationStats {
+	s.rotator.mu.Lock()
+	defer s.rotator.mu.Unlock()
+	return s.rotator.stats
+}
+
+// RotateKey makes a new master key active for new writes, hands it to every
+// peer and starts moving the files of this node to it. It returns the ID of
+// the key.
+func (s *FileServer) RotateKey() (string, error) {
+	prev := s.Keystore.Active()
+	key, err := s.Keystore.Rotate()
+	if err != nil {
+		return "", err
+	}
+	log.Printf("[%s] rotating to key %s\n", s.Transport.ListenAddr(), key.ID)
+	s.startRotation()
+
+	wk, err := wrapKey(prev.Key, key.Key)
+	if err != nil {
+		return "", err
+	}
+	msg := Message{
+		Payload: MessageRotateKey{By: prev.ID, Key: wk},
+	}
+	return key.ID, s.broadCast(&msg)
+}
+
+func (s *FileServer) handleMessageRotateKey(from string, msg MessageRotateKey) error {
+	if s.Keystore.Active().ID == msg.Key.ID {
+		return nil
+	}
+	by, err := s.Keystore.Key(msg.By)
+	if err != nil {
+		return err
+	}
+	key, err := unwrapKey(by, msg.Key)
+	if err != nil {
+		return fmt.Errorf("key %s from %s does not unwrap: %w", msg.Key.ID, from, err)
+	}
+	if _, err := s.Keystore.activate(key); err != nil {
+		return err
+	}
+	log.Printf("[%s] rotating to key %s from %s\n", s.Transport.ListenAddr(), msg.Key.ID, from)
+	s.startRotation()
+	return nil
+}
+
+// startRotation moves the files of this node to the active key in the
+// background, stopping a rotation to an older key.
+func (s *FileServer) startRotation() {
+	s.rotator.mu.Lock()
+	s.rotator.gen++
+	gen := s.rotator.gen
+	s.rotator.stats = RotationStats{Key: s.Keystore.Active().ID, Started: time.Now()}
+	s.rotator.mu.Unlock()
+
+	go s.rotate(gen)
+}
+
+func (s *FileServer) rotate(gen int) {
+	to := s.Keystore.Active()
+	files := s.staleFiles(to.ID)
+	if !s.rotator.update(gen, func(st *RotationStats) { st.Files = len(files) }) {
+		return
+	}
+
+	rate := cmp.Or(s.RotateRate, DefaultRotateRate)
+	failed := 0
+	for _, entry := range files {
+		select {
+		case <-s.quitch:
+			return
+		default:
+		}
+		n, err := s.rotateFile(entry, to, rate)
+		if err != nil {
+			failed++
+			log.Printf("[%s] unable to move [%s] to key %s: %s\n", s.Transport.ListenAddr(), entry.Key, to.ID, err)
+		}
+		ok := s.rotator.update(gen, func(st *RotationStats) {
+			st.Bytes += n
+			if err != nil {
+				st.Failed++
+			} else {
+				st.Moved++
+			}
+		})
+		if !ok {
+			return
+		}
+	}
+
+	s.rotator.update(gen, func(st *RotationStats) { st.Finished = time.Now() })
+	log.Printf("[%s] moved %d file(s) to key %s, %d failed\n", s.Transport.ListenAddr(), len(files)-failed, to.ID, failed)
+}
+
+// staleFiles returns the entries of the files encrypted with another key
+// than the master key active.
+func (s *FileServer) staleFiles(active string) []IndexEntry {
+	var files []IndexEntry
+	for _, entry := range s.store.index.Entries("") {
+		if entry.KeyID != "" && entry.KeyID != active {
+			files = append(files, entry)
+		}
+	}
+	return files
+}
+
+// RetireKeys retires the master keys no file of this node records anymore,
+// and asks every peer to do the same. It returns the IDs of the keys this node
+// retired. Keys a file still records, because a rotation has not moved it
+// yet or failed to, are kept until the next RetireKeys.
+func (s *FileServer) RetireKeys() ([]string, error) {
+	retired, err := s.retireKeys()
+	if err != nil {
+		return nil, err
+	}
+	msg := Message{
+		Payload: MessageRetireKeys{},
+	}
+	return retired, s.broadCast(&msg)
+}
+
+func (s *FileServer) retireKeys() ([]string, error) {
+	inUse := make(map[string]bool)
+	for _, entry := range s.store.index.Entries("") {
+		if entry.KeyID != "" {
+			inUse[entry.KeyID] = true
+		}
+	}
+	retired, err := s.Keystore.Retire(inUse)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[%s] retired key(s) %v, kept %v\n", s.Transport.ListenAddr(), retired, s.Keystore.IDs())
+	return retired, nil
+}
+
+func (s *FileServer) handleMessageRetireKeys(from string, msg MessageRetireKeys) error {
+	_, err := s.retireKeys()
+	return err
+}
+
+// rotateFile writes the file of entry again under the master key to, reading
+// rate bytes per second. It returns the bytes read. Cached copies are dropped
+// instead, the next read fetches them again.
+func (s *FileServer) rotateFile(entry IndexEntry, to MasterKey, rate int64) (int64, error) {
+	if entry.Cached {
+		s.cache.remove(entry.Key)
+		return 0, s.store.Delete(entry.Key)
+	}
+	_, r, err := s.store.readStream(entry.Key)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	// a key written or deleted since the rotation started moved already
+	if cur, ok := s.store.index.Get(entry.Key); !ok || cur.Checksum != entry.Checksum {
+		return 0, nil
+	}
+	tr := &throttledReader{r: r, rate: rate, start: time.Now()}
+	check := writeCheck{Plain: entry.Plain, Keys: s.Keystore}
+	_, err = s.store.writeEntry(entry.Key, entry.Name, entry.Length, check, func(w io.Writer) error {
+		return rekey(s.Keystore, to, tr, w)
+	})
+	return tr.n, err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRotateKey(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	if err := s.PutBucket(BucketConfig{Name: "sec", Encrypt: true}); err != nil {
+		t.Fatal(err)
+	}
+	old := s.Keystore.Active()
+
+	// replicas like peers send them, one with a data key and one from before
+	data := bytes.Repeat([]byte("rotate me "), 10000)
+	sealed := new(bytes.Buffer)
+	if _, err := copyEncrypt(old, bytes.NewReader(data), sealed); err != nil {
+		t.Fatal(err)
+	}
+	replicas := map[string][]byte{
+		hashKey("sec/new"): sealed.Bytes(),
+		hashKey("sec/old"): encryptCTR(t, old.Key, data),
+	}
+	names := map[string]string{hashKey("sec/new"): "sec/new", hashKey("sec/old"): "sec/old"}
+	for key, wire := range replicas {
+		check := writeCheck{Keys: s.Keystore}
+		if _, err := s.store.writeVerified(key, names[key], int64(len(data)), check, bytes.NewReader(wire)); err != nil {
+			t.Fatal(err)
+		}
+		s.store.index.Ref(key, "sec/obj", true)
+	}
+
+	id, err := s.RotateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); s.RotationStats().Finished.IsZero(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("rotation did not finish: %+v", s.RotationStats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := s.RotationStats()
+	if stats.Key != id || stats.Files != 2 || stats.Moved != 2 || stats.Failed != 0 {
+		t.Errorf("have %+v want 2 files moved to %s", stats, id)
+	}
+	// peers may still be moving theirs
+	if _, err := s.Keystore.Key(old.ID); err != nil {
+		t.Errorf("have %v want the old key kept until it is retired", err)
+	}
+
+	for key := range replicas {
+		entry, _ := s.store.index.Get(key)
+		if entry.KeyID != id || !reflect.DeepEqual(entry.Refs, []string{"sec/obj"}) {
+			t.Errorf("have key %s refs %v of [%s] want %s", entry.KeyID, entry.Refs, key, id)
+		}
+		_, r, err := s.store.readStream(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := new(bytes.Buffer)
+		_, err = copyDecrypt(s.Keystore, r, out)
+		r.Close()
+		if err != nil || !bytes.Equal(out.Bytes(), data) {
+			t.Errorf("have %d bytes of [%s], %v", out.Len(), key, err)
+		}
+	}
+
+	// the replica with a data key only got a new header
+	moved, _ := os.ReadFile(s.store.Root + "/" + CASPathTransform(hashKey("sec/new")).FullPath())
+	if !bytes.Equal(moved[encHeaderSize:], sealed.Bytes()[encHeaderSize:]) {
+		t.Error("expected the segments to stay as they were")
+	}
+
+	// a file still encrypted with the old key keeps it
+	stale := hashKey("sec/stale")
+	check := writeCheck{Keys: s.Keystore}
+	if _, err := s.store.writeVerified(stale, "sec/stale", int64(len(data)), check, bytes.NewReader(sealed.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if retired, err := s.RetireKeys(); err != nil || len(retired) != 0 {
+		t.Errorf("have retired %v, %v want the old key kept", retired, err)
+	}
+	if err := s.store.Delete(stale); err != nil {
+		t.Fatal(err)
+	}
+	if retired, err := s.RetireKeys(); err != nil || !reflect.DeepEqual(retired, []string{old.ID}) {
+		t.Errorf("have retired %v, %v want %s", retired, err, old.ID)
+	}
+	if _, err := s.Keystore.Key(old.ID); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("have %v want the old key retired", err)
+	}
+}
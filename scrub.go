@@ -0,0 +1,290 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The scrubber re-reads every file of the store in the background, slowly
+// enough not to compete with reads, and checks it against the checksum it was
+// written with. A corrupt file is moved to the quarantine and replaced with a
+// healthy copy from this node or a peer, which keeps the references of the
+// chunk it holds. Cached copies are dropped instead, the next read fetches
+// them again.
+
+// DefaultScrubRate is the bytes per second the scrubber reads when
+// FileServerOpts does not set ScrubRate.
+const DefaultScrubRate int64 = 1 << 20
+
+// ScrubInterval is how long a node rests between two scrubs of its store.
+var ScrubInterval = time.Hour
+
+// ScrubStats reports the progress of the scrubber of a node.
+type ScrubStats struct {
+	Passes   int       // scrubs of the whole store completed
+	Scanned  int       // keys checked by the current or last scrub
+	Keys     int       // keys to check in the current or last scrub
+	Bytes    int64     // bytes read since the node started
+	Corrupt  int       // corrupt files found since the node started
+	Repaired int       // files replaced with a healthy copy
+	LastPass time.Time // when the last scrub completed, zero before
+}
+
+type scrubber struct {
+	mu    sync.Mutex
+	stats ScrubStats
+}
+
+func (sc *scrubber) update(fn func(*ScrubStats)) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	fn(&sc.stats)
+}
+
+func (s *FileServer) ScrubStats() ScrubStats {
+	s.scrubber.mu.Lock()
+	defer s.scrubber.mu.Unlock()
+	return s.scrubber.stats
+}
+
+func (s *FileServer) scrubLoop() {
+	if s.ScrubRate < 0 {
+		return
+	}
+	ticker := time.NewTicker(ScrubInterval)
+	defer ticker.Stop()
+
+	// files Reconcile marked corrupt are not left for a whole interval
+	if slices.ContainsFunc(s.store.index.Entries(""), func(e IndexEntry) bool { return e.Corrupt }) {
+		s.scrub()
+	}
+	for {
+		select {
+		case <-ticker.C:
+			s.scrub()
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// scrub checks every key of the store once, those marked corrupt first. It
+// returns early when the node stops.
+func (s *FileServer) scrub() {
+	entries := s.store.index.Entries("")
+	slices.SortStableFunc(entries, func(a, b IndexEntry) int {
+		switch {
+		case a.Corrupt == b.Corrupt:
+			return 0
+		case a.Corrupt:
+			return -1
+		}
+		return 1
+	})
+	s.scrubber.update(func(st *ScrubStats) {
+		st.Scanned = 0
+		st.Keys = len(entries)
+	})
+	log.Printf("[%s] scrubbing %d key(s)\n", s.Transport.ListenAddr(), len(entries))
+
+	rate := cmp.Or(s.ScrubRate, DefaultScrubRate)
+	for _, entry := range entries {
+		select {
+		case <-s.quitch:
+			return
+		default:
+		}
+		s.scrubKey(entry.Key, rate)
+	}
+
+	s.scrubber.update(func(st *ScrubStats) {
+		st.Passes++
+		st.LastPass = time.Now()
+	})
+}
+
+// scrubKey checks the file of key, reading rate bytes per second, and repairs
+// it if it is corrupt or gone.
+func (s *FileServer) scrubKey(key string, rate int64) {
+	entry, ok := s.store.index.Get(key)
+	if !ok {
+		return
+	}
+	n, err := s.store.verify(entry, func(r io.Reader) io.Reader {
+		return &throttledReader{r: r, rate: rate, start: time.Now()}
+	})
+	s.scrubber.update(func(st *ScrubStats) {
+		st.Scanned++
+		st.Bytes += n
+	})
+
+	var integrity *IntegrityError
+	switch {
+	case err == nil:
+		return
+	case errors.As(err, &integrity), errors.Is(err, os.ErrNotExist):
+	default:
+		log.Printf("[%s] unable to scrub [%s]: %s\n", s.Transport.ListenAddr(), key, err)
+		return
+	}
+
+	// a key written or deleted while it was read is not corrupt
+	cur, ok := s.store.index.Get(key)
+	if !ok || cur.Checksum != entry.Checksum || !cur.ModTime.Equal(entry.ModTime) {
+		return
+	}
+
+	if integrity != nil {
+		s.scrubber.update(func(st *ScrubStats) { st.Corrupt++ })
+		path, err := s.store.quarantine(key)
+		if err != nil {
+			log.Printf("[%s] unable to quarantine corrupt [%s]: %s\n", s.Transport.ListenAddr(), key, err)
+			return
+		}
+		log.Printf("[%s] %s, quarantined to %s\n", s.Transport.ListenAddr(), integrity, path)
+	}
+
+	if err := s.restore(entry); err != nil {
+		log.Printf("[%s] unable to repair [%s]: %s\n", s.Transport.ListenAddr(), key, err)
+		return
+	}
+	s.scrubber.update(func(st *ScrubStats) { st.Repaired++ })
+	log.Printf("[%s] repaired [%s]\n", s.Transport.ListenAddr(), key)
+}
+
+// restore writes a healthy copy of the data of entry in place of its file.
+// The copy is read from the other copy this node may hold, or else from the
+// first peer holding the copy of the node that stored the object or a
+// replica. It must match the checksum of the original data.
+func (s *FileServer) restore(entry IndexEntry) error {
+	if entry.Cached {
+		s.cache.remove(entry.Key)
+		return s.store.Delete(entry.Key)
+	}
+	cfg, err := s.copyConfig(entry.Name)
+	if err != nil {
+		return err
+	}
+
+	// a replica is stored like handleMessageStoreFile would, other copies
+	// hold the data as it is and must hash as before
+	check := writeCheck{Plain: entry.Plain}
+	replica := entry.Key != entry.Name
+	if replica && cfg.Encrypt {
+		check.Keys = s.Keystore
+	} else {
+		check.Checksum = entry.Checksum
+	}
+	write := func(r io.Reader) error {
+		_, err := s.store.writeEntry(entry.Key, entry.Name, entry.Length, check, func(w io.Writer) error {
+			if check.Keys != nil && cfg.Convergent {
+				data, err := io.ReadAll(r)
+				if err != nil {
+					return err
+				}
+				_, err = s.encryptCopy(cfg, data, w)
+				return err
+			}
+			if check.Keys != nil {
+				_, err := copyEncrypt(s.Keystore.Active(), r, w)
+				return err
+			}
+			_, err := io.Copy(w, r)
+			return err
+		})
+		return err
+	}
+
+	// the copies of the data other than the one being restored
+	type source struct {
+		key       string
+		encrypted bool
+	}
+	sources := []source{{entry.Name, false}, {hashKey(entry.Name), cfg.Encrypt}}
+	if !replica {
+		sources = sources[1:]
+	}
+
+	for _, src := range sources {
+		if _, r, err := s.store.readStream(src.key); err == nil {
+			err := s.restoreFrom(r, src.encrypted, write)
+			r.Close()
+			if err == nil {
+				return nil
+			}
+			log.Printf("[%s] local [%s] unusable: %s\n", s.Transport.ListenAddr(), src.key, err)
+		}
+	}
+	for _, peer := range s.placePeers(entry.Name, 0) {
+		for _, src := range sources {
+			r, err := s.openKey(peer, src.key, entry.Name, src.encrypted)
+			if err != nil {
+				continue
+			}
+			err = write(r)
+			r.Close()
+			if err == nil {
+				return nil
+			}
+			log.Printf("[%s] [%s] of [%s] unusable: %s\n", s.Transport.ListenAddr(), src.key, peer.RemoteAddr(), err)
+		}
+	}
+	return fmt.Errorf("no healthy copy of [%s] left", entry.Name)
+}
+
+// restoreFrom writes the data of a local copy, decrypting it first if it is
+// encrypted.
+func (s *FileServer) restoreFrom(r io.Reader, encrypted bool, write func(io.Reader) error) error {
+	if !encrypted {
+		return write(r)
+	}
+	dr, err := newDecryptReader(s.Keystore, r)
+	if err != nil {
+		return err
+	}
+	return write(dr)
+}
+
+// copyConfig returns the config of the bucket the copies of name were
+// replicated with.
+func (s *FileServer) copyConfig(name string) (BucketConfig, error) {
+	bucket, _, _ := strings.Cut(name, "/")
+	switch bucket {
+	case chunkBucket, shardBucket:
+		return BucketConfig{Name: bucket}, nil
+	case encChunkBucket, encShardBucket:
+		return BucketConfig{Name: bucket, Encrypt: true}, nil
+	case convChunkBucket, convShardBucket:
+		return BucketConfig{Name: bucket, Encrypt: true, Convergent: true}, nil
+	case uploadBucket, blobBucket:
+		return s.bucket(DefaultBucket)
+	}
+	return s.bucket(bucket)
+}
+
+// throttledReader reads r no faster than rate bytes per second.
+type throttledReader struct {
+	r     io.Reader
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func (t *throttledReader) Read(b []byte) (int, error) {
+	// small reads keep the pace even
+	n, err := t.r.Read(b[:min(len(b), 32<<10)])
+	t.n += int64(n)
+	due := t.start.Add(time.Duration(float64(t.n) / float64(t.rate) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestScrub(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	s.ScrubRate = 1 << 30
+
+	data := []byte("an object whose chunks rot on disk")
+	if err := s.Store(DefaultBucket, "doc", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	manifest, _ := s.localManifest(objectKey(DefaultBucket, "doc"))
+	healthy, lost := manifest.chunkKey(manifest.Chunks[0].ID), manifest.chunkKey(manifest.Chunks[1].ID)
+	refs := []string{objectKey(DefaultBucket, "doc")}
+
+	// this node also holds a replica of the first chunk, like one a peer sent
+	wire := new(bytes.Buffer)
+	if _, err := copyEncrypt(s.Keystore.Active(), bytes.NewReader(data[:8]), wire); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.store.writeObject(hashKey(healthy), healthy, 8, wire); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{healthy, lost} {
+		path := s.store.Root + "/" + CASPathTransform(key).FullPath()
+		if err := os.WriteFile(path, []byte("rotten!!"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.scrub()
+	stats := s.ScrubStats()
+	if stats.Passes != 1 || stats.Scanned != stats.Keys || stats.Corrupt != 2 || stats.Repaired != 1 {
+		t.Errorf("have %+v want 2 corrupt chunks, 1 repaired", stats)
+	}
+
+	_, r, err := s.store.readStream(healthy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := io.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(out, data[:8]) {
+		t.Errorf("have %q want the chunk repaired to %q", out, data[:8])
+	}
+	for _, key := range []string{healthy, lost} {
+		if entry, _ := s.store.index.Get(key); !reflect.DeepEqual(entry.Refs, refs) {
+			t.Errorf("have refs %v of [%s] want %v", entry.Refs, key, refs)
+		}
+	}
+	if files, _ := os.ReadDir(s.store.Root + "/" + quarantineDirName); len(files) != 2 {
+		t.Errorf("have %d files in quarantine want 2", len(files))
+	}
+
+	// the chunk without a healthy copy stays a failed repair
+	s.scrub()
+	if stats := s.ScrubStats(); stats.Corrupt != 2 || stats.Repaired != 1 {
+		t.Errorf("have %+v want the lost chunk not counted twice", stats)
+	}
+}
@@ -2,13 +2,17 @@ package main
 
 import (
 	"bytes"
+	"cmp"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"reflect"
+	"sort"
 	"sync"
 	"time"
 
@@ -27,23 +31,54 @@ const (
 )
 
 type FileServerOpts struct {
-	EncKey         []byte
+	// Keystore holds the master keys data is encrypted with. Unless set, a
+	// keystore kept in memory holds EncKey, or a random key if that is unset
+	// too.
+	Keystore *Keystore
+	EncKey   []byte
+
 	Transport      p2p.Transport
 	BootstrapNodes []string
 
 	// StoreOpts
 	StorageRoot       string
 	PathTransfromFunc PathTransfromFunc
+
+	// ChunkSize is the size objects are split into, DefaultChunkSize if unset.
+	ChunkSize int64
+
+	// CacheSize is the bytes the copies fetched to serve reads may take on
+	// disk, unbounded if unset.
+	CacheSize int64
+
+	// UploadTTL is how long incomplete multipart uploads are kept,
+	// DefaultUploadTTL if unset.
+	UploadTTL time.Duration
+
+	// ScrubRate is the bytes per second the scrubber reads the store at,
+	// DefaultScrubRate if unset. A negative rate turns the scrubber off.
+	ScrubRate int64
+
+	// RotateRate is the bytes per second a key rotation reads the store at,
+	// DefaultRotateRate if unset.
+	RotateRate int64
 }
 
 type FileServer struct {
 	FileServerOpts
 
-	store  *Store
-	quitch chan struct{}
+	store   *Store
+	buckets *BucketRegistry
+	cache   *objectCache
+	quitch  chan struct{}
+
+	transfers *TransferRegistry
+	scrubber  scrubber
+	rotator   rotator
 
 	peerLock sync.Mutex
 	peers    map[string]p2p.Peer
+	reqLocks map[string]*sync.Mutex // by peer address, see lockPeers
 }
 
 func NewFileServer(opts FileServerOpts) *FileServer {
@@ -51,40 +86,124 @@ func NewFileServer(opts FileServerOpts) *FileServer {
 		Root:              opts.StorageRoot,
 		PathTransfromFunc: opts.PathTransfromFunc,
 	}
-	return &FileServer{
+	store := NewStore(storeOpts)
+	if opts.Keystore == nil {
+		if opts.EncKey == nil {
+			opts.EncKey = newEncryptionKey()
+		}
+		opts.Keystore = NewKeystore(opts.EncKey)
+	}
+	s := &FileServer{
 		FileServerOpts: opts,
-		store:          NewStore(storeOpts),
+		store:          store,
+		buckets:        NewBucketRegistry(store.Root),
+		cache:          newObjectCache(opts.CacheSize),
+		transfers:      NewTransferRegistry(store.Root),
 		quitch:         make(chan struct{}),
 		peers:          make(map[string]p2p.Peer),
+		reqLocks:       make(map[string]*sync.Mutex),
 	}
+	s.loadCache()
+	return s
 }
 
 func (s *FileServer) broadCast(msg *Message) error {
 	log.Printf("broadcasting msg: %+v", *msg)
+	return s.sendTo(s.peerList(), msg)
+}
+
+// sendTo sends msg to every peer in peers. A peer that cannot be reached is
+// logged and skipped.
+func (s *FileServer) sendTo(peers []p2p.Peer, msg *Message) error {
 	buf := new(bytes.Buffer)
 	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
 		return err
 	}
 
-	for _, peer := range s.peers {
-		if err := peer.Send([]byte{p2p.IncomingMessage}); err == nil {
-			if err := peer.Send(buf.Bytes()); err != nil {
-				log.Printf("Error sending message to peer [%s]", peer.LocalAddr())
-			}
-		} else {
-			log.Printf("error: unable brodcast msg to: [%s]", peer.LocalAddr())
+	for _, peer := range peers {
+		if err := peer.SendMessage(buf.Bytes()); err != nil {
+			log.Printf("error: unable to send msg to: [%s]", peer.RemoteAddr())
 		}
 	}
 	return nil
 }
 
+func (s *FileServer) send(peer p2p.Peer, msg *Message) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+	return peer.SendMessage(buf.Bytes())
+}
+
+// peer returns the connected peer with address addr.
+func (s *FileServer) peer(addr string) (p2p.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peer, ok := s.peers[addr]
+	return peer, ok
+}
+
+func (s *FileServer) peerList() []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// lockPeers serializes requests to peers. A peer answers requests in order,
+// so a node may only have one request per peer waiting for its reply. Locks
+// are taken in address order, so overlapping sets of peers cannot deadlock.
+func (s *FileServer) lockPeers(peers []p2p.Peer) (unlock func()) {
+	addrs := make([]string, len(peers))
+	for i, peer := range peers {
+		addrs[i] = peer.RemoteAddr().String()
+	}
+	sort.Strings(addrs)
+
+	s.peerLock.Lock()
+	locks := make([]*sync.Mutex, len(addrs))
+	for i, addr := range addrs {
+		if s.reqLocks[addr] == nil {
+			s.reqLocks[addr] = new(sync.Mutex)
+		}
+		locks[i] = s.reqLocks[addr]
+	}
+	s.peerLock.Unlock()
+
+	for _, l := range locks {
+		l.Lock()
+	}
+	return func() {
+		for _, l := range locks {
+			l.Unlock()
+		}
+	}
+}
+
 type Message struct {
 	Payload any
 }
 
 type MessageStoreFile struct {
-	Key  string
-	Size int64
+	Key       string
+	Name      string // original key, recorded by the replica for listing
+	Size      int64  // bytes of the stream following the message
+	Length    int64  // length of the original object
+	Encrypted bool
+	Checksum  string // hex SHA-256 of the stream, verified by the replica
+	Plain     string // hex SHA-256 of the original data, verified by the replica
+}
+
+type MessageListKeys struct {
+	Prefix string
+	Cursor string
+	Limit  int
 }
 
 type MessageFileKey struct {
@@ -92,16 +211,84 @@ type MessageFileKey struct {
 	Action FILE_ACTION
 }
 
-func (s *FileServer) Get(key string) (io.Reader, error) {
+// Get returns a reader of the object under key, which the caller closes.
+func (s *FileServer) Get(bucket, key string) (io.ReadCloser, error) {
+	cfg, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	key = objectKey(bucket, key)
+
+	s.account(key)
 	if s.store.Has(key) {
 		log.Printf("[%s] serving file [%s] from local disk\n", s.Transport.ListenAddr(), key)
-		_, r, err := s.store.Read(key)
-		if err != nil {
+	} else {
+		log.Printf("[%s] dont have [%s] file locally, fetching from network", s.Transport.ListenAddr(), key)
+		if err := s.fetch(cfg, key); err != nil {
 			return nil, err
 		}
-		return r, err
+		s.cacheFetched(key)
+	}
+
+	_, r, err := s.store.readStream(key)
+	if err != nil {
+		return nil, err
+	}
+	manifest, ok, rest, err := readManifest(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	if !ok {
+		// objects stored before chunking are checked as a whole and read from
+		// the file, which closing the reader closes
+		var body io.Reader = rest
+		if entry, _ := s.store.index.Get(key); entry.Plain != "" {
+			body = &verifyReader{r: rest, hash: sha256.New(), want: entry.Plain, key: key}
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{body, r}, nil
+	}
+	r.Close()
+
+	// accounted before the swarm brings the chunks in
+	for _, ref := range manifest.Chunks {
+		s.account(manifest.chunkKey(ref.ID))
+	}
+	cr := &chunkReader{
+		s:        s,
+		cfg:      cfg,
+		manifest: manifest,
+		chunks:   manifest.Chunks,
+		jobs:     s.startSwarm(cfg, manifest),
+	}
+	if manifest.Checksum == "" {
+		return io.NopCloser(cr), nil
+	}
+	return io.NopCloser(&verifyReader{r: cr, hash: sha256.New(), want: manifest.Checksum, key: key}), nil
+}
+
+// fetch asks every peer for key and writes the first copy received to the
+// local store. The copies of the other peers are read and dropped.
+func (s *FileServer) fetch(cfg BucketConfig, key string) error {
+	return s.fetchVerified(cfg, key, "")
+}
+
+// fetchVerified is fetch checking the copy against want, the hex SHA-256 of
+// the data, or else against the checksum the peer sends along. A copy that
+// fails the check is dropped and the next peer is tried.
+func (s *FileServer) fetchVerified(cfg BucketConfig, key, want string) error {
+	// a replica held by this node is as good as a remote copy
+	if data, ok := s.readReplica(cfg, key); ok {
+		entry, _ := s.store.index.Get(hashKey(key))
+		_, err := s.store.writeVerified(key, key, entry.Length, writeCheck{Plain: cmp.Or(want, entry.Plain)}, bytes.NewReader(data))
+		if err == nil {
+			return nil
+		}
+		log.Printf("[%s] replica of [%s] unusable: %s\n", s.Transport.ListenAddr(), key, err)
 	}
-	log.Printf("[%s] dont have [%s] file locally, fetching from network", s.Transport.ListenAddr(), key)
 
 	msg := Message{
 		Payload: MessageFileKey{
@@ -110,43 +297,104 @@ func (s *FileServer) Get(key string) (io.Reader, error) {
 		},
 	}
 
-	// peerWriters := s.peersWriter()
-	// mw := io.MultiWriter(peerWriters...)
-	// mw.Write([]byte{p2p.IncomingMessage})
-
-	if err := s.broadCast(&msg); err != nil {
-		return nil, err
+	peers := s.peerList()
+	defer s.lockPeers(peers)()
+	if err := s.sendTo(peers, &msg); err != nil {
+		return err
 	}
 
-	time.Sleep(time.Second * 5)
-
-	time.Sleep(time.Millisecond * 500)
-
-	var filesize int64
-	for _, peer := range s.peers {
-
-		binary.Read(peer, binary.LittleEndian, &filesize)
-
-		if filesize == -1 {
-			log.Printf("file not found on server [%s]\n", peer.LocalAddr())
+	found := false
+	for _, peer := range peers {
+		if err := peer.AwaitStream(); err != nil {
 			continue
 		}
 
-		n, err := s.store.writeDecrypt(s.EncKey, key, io.LimitReader(peer, filesize))
+		ok, err := s.receive(peer, cfg, key, want, found)
+		peer.CloseStream()
 		if err != nil {
-			log.Printf("Error: [%s] failed while writing from peer: %s", s.Transport.ListenAddr(), peer.LocalAddr())
+			log.Printf("Error: [%s] failed while reading from peer: %s: %s", s.Transport.ListenAddr(), peer.RemoteAddr(), err)
 			continue
 		}
-		log.Printf("[%s] received bytes over the network %d from [%s]\n", s.Transport.ListenAddr(), n, peer.LocalAddr())
-		peer.CloseStream()
+		if !ok {
+			log.Printf("file not found on server [%s]\n", peer.RemoteAddr())
+			continue
+		}
+		found = true
+	}
+
+	if !found {
+		return errors.New("key does not exist in network")
+	}
+	return nil
+}
+
+// fetchFrom asks peer alone for key and writes its copy to the local store,
+// verified like by fetchVerified.
+func (s *FileServer) fetchFrom(peer p2p.Peer, cfg BucketConfig, key, want string) error {
+	msg := Message{
+		Payload: MessageFileKey{
+			Key:    hashKey(key),
+			Action: ACTION_GET,
+		},
 	}
+	defer s.lockPeers([]p2p.Peer{peer})()
+	if err := s.send(peer, &msg); err != nil {
+		return err
+	}
+	if err := peer.AwaitStream(); err != nil {
+		return err
+	}
+	defer peer.CloseStream()
 
-	if filesize == -1 {
-		return nil, errors.New("key does not exist in network")
+	ok, err := s.receive(peer, cfg, key, want, false)
+	if err == nil && !ok {
+		err = fmt.Errorf("peer does not hold [%s]", key)
 	}
+	return err
+}
 
-	_, r, err := s.store.Read(key)
-	return r, err
+// receive reads the reply of peer to a GET of key and writes the copy to the
+// local store, or drops it if discard is set. It reports whether peer had key.
+// The copy is only kept if it matches want, or the checksum sent by peer when
+// want is empty.
+func (s *FileServer) receive(peer p2p.Peer, cfg BucketConfig, key, want string, discard bool) (bool, error) {
+	var filesize int64
+	if err := binary.Read(peer, binary.LittleEndian, &filesize); err != nil {
+		return false, err
+	}
+	if filesize == FILE_NOT_FOUND {
+		return false, nil
+	}
+	var length int64
+	if err := binary.Read(peer, binary.LittleEndian, &length); err != nil {
+		return false, err
+	}
+	plain, err := readPlainSum(peer)
+	if err != nil {
+		return false, err
+	}
+	want = cmp.Or(want, plain)
+
+	// a copy cut short fails to write rather than being kept truncated
+	body := &exactReader{r: peer, n: filesize}
+	defer io.Copy(io.Discard, body)
+	if discard {
+		return true, nil
+	}
+
+	var n int64
+	if cfg.Encrypt {
+		var dn int
+		dn, err = s.store.writeDecrypt(s.Keystore, key, length, want, body)
+		n = int64(dn)
+	} else {
+		n, err = s.store.writeVerified(key, key, length, writeCheck{Plain: want}, body)
+	}
+	if err != nil {
+		return true, err
+	}
+	log.Printf("[%s] received bytes over the network %d from [%s]\n", s.Transport.ListenAddr(), n, peer.RemoteAddr())
+	return true, nil
 }
 
 func (s *FileServer) Start() error {
@@ -155,6 +403,13 @@ func (s *FileServer) Start() error {
 		return err
 	}
 	s.bootstrapNetwork()
+	go s.retentionLoop()
+	go s.uploadGCLoop()
+	go s.scrubLoop()
+	// a rotation that did not finish before the node stopped
+	if len(s.staleFiles(s.Keystore.Active().ID)) > 0 {
+		s.startRotation()
+	}
 	s.loop()
 	return nil
 }
@@ -167,6 +422,7 @@ func (s *FileServer) loop() {
 	defer func() {
 		log.Println("file server stopped due to error or user quit action")
 		s.Transport.Close()
+		s.store.Close()
 	}()
 
 	for {
@@ -177,12 +433,16 @@ func (s *FileServer) loop() {
 			var msg Message
 			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
 				log.Println("decoding error:", err)
+				if rpc.Stream {
+					// the read loop of the peer waits for the stream to be read
+					rpc.Peer.CloseStream()
+				}
 				continue
 			}
 			log.Printf("Received msg: %+v\n", msg)
 			log.Println(reflect.TypeOf(msg.Payload))
 
-			if err := s.handleMessage(rpc.From.String(), &msg); err != nil {
+			if err := s.handleMessage(rpc, &msg); err != nil {
 				log.Println("handle message error:", err)
 			}
 		case <-s.quitch:
@@ -192,64 +452,222 @@ func (s *FileServer) loop() {
 	}
 }
 
+// keyHandshake starts the handshake of two nodes, it is followed by the ID
+// of the active key of the node.
+const keyHandshake = "dfs-keys/1\n"
+
+// HandshakeTimeout bounds how long a node waits for the handshake of a peer.
+var HandshakeTimeout = 10 * time.Second
+
+// Handshake tells a newly connected peer the ID of the active key of this
+// node and refuses the peer unless this node holds the key the peer encrypts
+// with. Nodes that hold different keys would drop every replica they send
+// each other.
+func (s *FileServer) Handshake(p p2p.Peer) error {
+	id := s.Keystore.Active().ID
+	if _, err := p.Write(append([]byte(keyHandshake), id...)); err != nil {
+		return err
+	}
+
+	p.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	defer p.SetReadDeadline(time.Time{})
+	b := make([]byte, len(keyHandshake)+len(id))
+	if _, err := io.ReadFull(p, b); err != nil {
+		return fmt.Errorf("handshake with [%s]: %w", p.RemoteAddr(), err)
+	}
+	if string(b[:len(keyHandshake)]) != keyHandshake {
+		return fmt.Errorf("handshake with [%s]: not a node of this file system", p.RemoteAddr())
+	}
+	if _, err := s.Keystore.Key(string(b[len(keyHandshake):])); err != nil {
+		return fmt.Errorf("handshake with [%s]: peer encrypts with a key this node lacks: %w", p.RemoteAddr(), err)
+	}
+	return nil
+}
+
 func (s *FileServer) OnPeer(p p2p.Peer, outbound bool) error {
 	s.peerLock.Lock()
-	defer s.peerLock.Unlock()
 	s.peers[p.RemoteAddr().String()] = p
+	s.peerLock.Unlock()
 	log.Printf("current local peer: %+v, current remote peer: %+v\n", p.LocalAddr(), p.RemoteAddr())
 	// log.Printf("connected with remote: %s\n", p.LocalAddr().String())
 
+	s.syncBuckets(p)
 	return nil
 }
 
-func (s *FileServer) peersWriter() (ioWriter []io.Writer) {
-	for _, peer := range s.peers {
+// OnPeerClose forgets a peer once its connection is gone.
+func (s *FileServer) OnPeerClose(p p2p.Peer) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	addr := p.RemoteAddr().String()
+	if s.peers[addr] == p {
+		delete(s.peers, addr)
+	}
+	log.Printf("[%s] lost peer [%s]\n", s.Transport.ListenAddr(), addr)
+}
+
+func peersWriter(peers []p2p.Peer) (ioWriter []io.Writer) {
+	for _, peer := range peers {
 		ioWriter = append(ioWriter, peer)
 	}
 	return ioWriter
 }
 
-func (s *FileServer) Store(key string, r io.Reader) error {
+// ObjectOpts override the settings of the bucket for a single Store.
+type ObjectOpts struct {
+	// Chunking is how the object is cut into chunks, the bucket decides if
+	// unset.
+	Chunking Chunking
+}
 
-	var (
-		fileBuff = new(bytes.Buffer)
-		tee      = io.TeeReader(r, fileBuff)
-	)
+// Store splits r into chunks that are stored and replicated one by one, then
+// stores the manifest listing them under key.
+func (s *FileServer) Store(bucket, key string, r io.Reader) error {
+	return s.StoreWithOpts(bucket, key, r, ObjectOpts{})
+}
+
+// StoreWithOpts is Store with the bucket settings overridden by opts.
+func (s *FileServer) StoreWithOpts(bucket, key string, r io.Reader, opts ObjectOpts) error {
+	cfg, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	if err := validChunking(opts.Chunking); err != nil {
+		return err
+	}
+	key = objectKey(bucket, key)
+
+	old, _ := s.localManifest(key)
+	hold := pendingRef()
+	c := s.limitChunks(cfg, bucket, key, 0, s.chunker(cmp.Or(opts.Chunking, cfg.Chunking), r))
+	manifest, err := s.storeChunks(cfg, c, old, hold)
+	if err == nil {
+		err = s.commitObject(cfg, bucket, key, manifest)
+	}
+	// the chunks stay if the object references them
+	if rerr := s.release(hold, manifest); err == nil {
+		err = rerr
+	}
+	return err
+}
 
-	size, err := s.store.Write(key, tee)
+// commitObject stores and replicates the manifest of an object whose chunks
+// are stored, and releases the chunks of the version it replaces.
+func (s *FileServer) commitObject(cfg BucketConfig, bucket, key string, manifest Manifest) error {
+	old, overwrite := s.localManifest(key)
+	b, err := encodeManifest(manifest)
 	if err != nil {
 		return err
 	}
 
+	// checked again, objects may have been stored since the chunks were; the
+	// version being replaced stays until the new one fits
+	if cfg.Quota > 0 && manifest.Size > s.quotaLeft(cfg, bucket, key) {
+		return fmt.Errorf("%w: %s holds more than %d bytes", ErrQuotaExceeded, bucket, cfg.Quota)
+	}
+
+	if _, err := s.store.writeObject(key, key, manifest.Size, bytes.NewReader(b)); err != nil {
+		return err
+	}
+	if err := s.retain(key, manifest); err != nil {
+		return err
+	}
+	if overwrite {
+		if err := s.releaseStale(key, old, manifest); err != nil {
+			return err
+		}
+	}
+
+	if err := s.replicate(cfg, key, manifest.Size, b); err != nil {
+		return err
+	}
+
+	log.Printf("[%s] stored [%s], %d bytes in %d chunk(s)\n", s.Transport.ListenAddr(), key, manifest.Size, len(manifest.Chunks))
+
+	return nil
+}
+
+// replicate sends data, stored locally under key, to the peers placed for key.
+// length is the length of the original object data belongs to.
+func (s *FileServer) replicate(cfg BucketConfig, key string, length int64, data []byte) error {
+	return s.replicateTo(s.placePeers(key, cfg.ReplicationFactor), cfg, key, length, data)
+}
+
+func (s *FileServer) replicateTo(peers []p2p.Peer, cfg BucketConfig, key string, length int64, data []byte) error {
+	if len(peers) == 0 {
+		return nil
+	}
+
+	// the stream is prepared up front so its checksum can go with the message
+	wire := data
+	if cfg.Encrypt {
+		buf := new(bytes.Buffer)
+		if _, err := s.encryptCopy(cfg, data, buf); err != nil {
+			return err
+		}
+		wire = buf.Bytes()
+	}
+	hash, plain := sha256.Sum256(wire), sha256.Sum256(data)
+
 	msg := Message{
 		Payload: MessageStoreFile{
-			Key:  hashKey(key),
-			Size: size + 16,
+			Key:       hashKey(key),
+			Name:      key,
+			Size:      int64(len(wire)),
+			Length:    length,
+			Encrypted: cfg.Encrypt,
+			Checksum:  hex.EncodeToString(hash[:]),
+			Plain:     hex.EncodeToString(plain[:]),
 		},
 	}
 
-	if err := s.broadCast(&msg); err != nil {
+	if err := s.streamTo(peers, &msg, wire); err != nil {
 		return err
 	}
 
-	time.Sleep(time.Second * 5)
-
-	peersWriter := s.peersWriter()
-	mw := io.MultiWriter(peersWriter...)
-	mw.Write([]byte{p2p.IncomingStream})
+	log.Printf("[%s] replicated (%d) bytes of [%s] to %d peer(s)\n", s.Transport.ListenAddr(), len(wire), key, len(peers))
+	return nil
+}
 
-	n, err := copyEncrypt(s.EncKey, fileBuff, mw)
-	if err != nil {
-		log.Println(err)
+// encryptCopy encrypts data, a copy replicated with cfg, into dst and returns
+// the bytes written.
+func (s *FileServer) encryptCopy(cfg BucketConfig, data []byte, dst io.Writer) (int, error) {
+	if cfg.Convergent {
+		return encryptConvergent(s.Keystore.Active(), data, dst)
 	}
+	return copyEncrypt(s.Keystore.Active(), bytes.NewReader(data), dst)
+}
 
-	log.Printf("[%s] received and written (%d) bytes to disk\n", s.Transport.ListenAddr(), n)
+// streamTo sends msg to peers, directly followed by stream, which peers read
+// while handling msg.
+func (s *FileServer) streamTo(peers []p2p.Peer, msg *Message, stream []byte) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
 
+	for _, peer := range peers {
+		if err := peer.SendStreamMessage(buf.Bytes(), stream); err != nil {
+			log.Printf("error: unable to open stream to: [%s]", peer.RemoteAddr())
+		}
+	}
 	return nil
-
 }
 
-func (s *FileServer) Delete(key string) error {
+func (s *FileServer) Delete(bucket, key string) error {
+	cfg, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	key = objectKey(bucket, key)
+
+	// the manifest tells which chunks to release
+	manifest, ok := s.localManifest(key)
+	if !ok && s.fetch(cfg, key) == nil {
+		manifest, ok = s.localManifest(key)
+	}
+
 	if s.store.Has(key) {
 		s.store.Delete(key)
 		log.Printf("file [%s] deleted from local\ndd", key)
@@ -263,24 +681,13 @@ func (s *FileServer) Delete(key string) error {
 		},
 	}
 
-	peerWrites := s.peersWriter()
-	mw := io.MultiWriter(peerWrites...)
-
-	// Send message type
-	mw.Write([]byte{p2p.IncomingMessage})
-
-	// encode message
-	buff := new(bytes.Buffer)
-	if err := gob.NewEncoder(buff).Encode(msg); err != nil {
-		log.Printf("error while encoding delete message\n%s\n", err)
-		return err
-	}
-
-	_, err := mw.Write(buff.Bytes())
-	if err != nil {
+	if err := s.broadCast(&msg); err != nil {
 		log.Printf("error occured while deleting file [%s] from network\n%s\n", key, err)
 		return err
 	}
+	if ok {
+		return s.release(key, manifest)
+	}
 	return nil
 
 }
@@ -301,30 +708,125 @@ func (s *FileServer) bootstrapNetwork() error {
 	return nil
 }
 
-func (s *FileServer) handleMessage(from string, msg *Message) error {
+// handleMessage dispatches msg, received with rpc. Messages followed by a
+// stream are handled with the peer that sent them, which must have its stream
+// closed however handling ends.
+func (s *FileServer) handleMessage(rpc p2p.RPC, msg *Message) error {
+	from := rpc.From.String()
 	switch v := msg.Payload.(type) {
 	case MessageStoreFile:
-		return s.handleMessageStoreFile(from, v)
+		return s.handleMessageStoreFile(rpc.Peer, v)
 	case MessageFileKey:
 		return s.handleMessageFileKey(from, v)
+	case MessageListKeys:
+		return s.handleMessageListKeys(rpc.Peer, v)
+	case MessageBucket:
+		return s.handleMessageBucket(from, v)
+	case MessageHasKeys:
+		return s.handleMessageHasKeys(from, v)
+	case MessageChunkRefs:
+		return s.handleMessageChunkRefs(from, v)
+	case MessageSignatures:
+		return s.handleMessageSignatures(rpc.Peer, v)
+	case MessageApplyDelta:
+		return s.handleMessageApplyDelta(rpc.Peer, v)
+	case MessageGetRange:
+		return s.handleMessageGetRange(from, v)
+	case MessageRotateKey:
+		return s.handleMessageRotateKey(from, v)
+	case MessageRetireKeys:
+		return s.handleMessageRetireKeys(from, v)
 	default:
 		log.Printf("message type not supported...\n")
+		if rpc.Stream {
+			rpc.Peer.CloseStream()
+		}
 	}
 
 	return nil
 }
 
-func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
-	peer, ok := s.peers[from]
-	if !ok {
-		log.Printf("peer map: %+v", s.peers)
-		return fmt.Errorf("missing peer from peer map: %s", from)
-	}
+func (s *FileServer) handleMessageStoreFile(peer p2p.Peer, msg MessageStoreFile) error {
 	defer peer.CloseStream()
+	from := peer.RemoteAddr().String()
 
-	s.store.Write(msg.Key, io.LimitReader(peer, msg.Size))
+	check := writeCheck{Checksum: msg.Checksum, Plain: msg.Plain}
+	if msg.Encrypted {
+		check.Keys = s.Keystore
+	}
+	r := &exactReader{r: peer, n: msg.Size}
+	_, err := s.store.writeVerified(msg.Key, msg.Name, msg.Length, check, r)
+
+	// leave the connection at the next message even if the write failed
+	io.Copy(io.Discard, r)
+	if err != nil {
+		return fmt.Errorf("replica of [%s] from %s: %w", msg.Name, from, err)
+	}
 	return nil
+}
+
+// handleMessageListKeys streams back a page of the objects held by this node.
+// handleMessageListKeys replies to peer even when it fails, the requester
+// waits for the reply while it holds the peer.
+func (s *FileServer) handleMessageListKeys(peer p2p.Peer, msg MessageListKeys) error {
+	infos, err := s.store.List(msg.Prefix)
+	if err != nil {
+		infos = nil
+		log.Printf("[%s] unable to list local keys: %s\n", s.Transport.ListenAddr(), err)
+	}
+	infos = paginate(infos, msg.Cursor, msg.Limit)
 
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(infos); err != nil {
+		replyNotFound(peer)
+		return err
+	}
+
+	return reply(peer, binary.LittleEndian.AppendUint64(nil, uint64(buf.Len())), buf.Bytes())
+}
+
+// reply answers a request of peer with the concatenation of parts. The reply
+// goes out in a single write, so that concurrent writes to the peer cannot
+// end up in the middle of it.
+func reply(peer p2p.Peer, parts ...[]byte) error {
+	b := []byte{p2p.IncomingStream}
+	for _, part := range parts {
+		b = append(b, part...)
+	}
+	return peer.Send(b)
+}
+
+// replyStream answers a request of peer with head followed by n bytes of r,
+// streamed rather than read into memory first. Like reply, nothing else is
+// written to the peer in between.
+func replyStream(peer p2p.Peer, head []byte, r io.Reader, n int64) error {
+	return peer.SendStream(append([]byte{p2p.IncomingStream}, head...), r, n)
+}
+
+// plainSum encodes the hex checksum of an original object for a reply, as
+// zeros if it is unknown.
+func plainSum(plain string) []byte {
+	sum := make([]byte, sha256.Size)
+	hex.Decode(sum, []byte(plain))
+	return sum
+}
+
+// readPlainSum reads a checksum encoded by plainSum, empty if unknown.
+func readPlainSum(r io.Reader) (string, error) {
+	sum := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, sum); err != nil {
+		return "", err
+	}
+	if bytes.Equal(sum, make([]byte, sha256.Size)) {
+		return "", nil
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+func replyNotFound(peer p2p.Peer) error {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, FILE_NOT_FOUND)
+	return reply(peer, buf.Bytes())
 }
 
 func (s *FileServer) handleMessageFileKey(from string, msg MessageFileKey) error {
@@ -332,13 +834,12 @@ func (s *FileServer) handleMessageFileKey(from string, msg MessageFileKey) error
 	switch msg.Action {
 
 	case "GET":
-		peer, ok := s.peers[from]
+		peer, ok := s.peer(from)
 		if !ok {
 			return fmt.Errorf("peer [%s] does not exist in peer map", from)
 		}
 		if !s.store.Has(msg.Key) {
-			peer.Send([]byte{p2p.IncomingStream})
-			binary.Write(peer, binary.LittleEndian, FILE_NOT_FOUND)
+			replyNotFound(peer)
 			return fmt.Errorf("[%s] need to serve file (%s) but it does not exist on disk", s.Transport.ListenAddr(), msg.Key)
 		}
 
@@ -346,6 +847,7 @@ func (s *FileServer) handleMessageFileKey(from string, msg MessageFileKey) error
 
 		fileSize, r, err := s.store.Read(msg.Key)
 		if err != nil {
+			replyNotFound(peer)
 			return err
 		}
 
@@ -354,13 +856,17 @@ func (s *FileServer) handleMessageFileKey(from string, msg MessageFileKey) error
 			defer rc.Close()
 		}
 
-		peer.Send([]byte{p2p.IncomingStream})
-		binary.Write(peer, binary.LittleEndian, fileSize)
-		n, err := io.Copy(peer, r)
-		if err != nil {
+		// the size of the stream is followed by the length and the checksum of
+		// the original object
+		entry, _ := s.store.index.Get(msg.Key)
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.LittleEndian, fileSize)
+		binary.Write(buf, binary.LittleEndian, entry.Length)
+		buf.Write(plainSum(entry.Plain))
+		if err := replyStream(peer, buf.Bytes(), r, fileSize); err != nil {
 			return err
 		}
-		log.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.ListenAddr(), n, from)
+		log.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.ListenAddr(), fileSize, from)
 
 		return nil
 
@@ -375,23 +881,15 @@ func (s *FileServer) handleMessageFileKey(from string, msg MessageFileKey) error
 			return err
 		}
 
-		peer, ok := s.peers[from]
+		peer, ok := s.peer(from)
 		if !ok {
 			return fmt.Errorf("peer [%s] does not exist in peer map", from)
 		}
 
-		peer.Send([]byte{p2p.IncomingMessage})
 		var ackSig Message = Message{
 			Payload: fmt.Appendf(nil, "ACK DEL from [%s]", from),
 		}
-		buff := new(bytes.Buffer)
-		if err := gob.NewEncoder(buff).Encode(ackSig); err != nil {
-			return err
-		}
-		if err := peer.Send(buff.Bytes()); err != nil {
-			return err
-		}
-		return nil
+		return s.send(peer, &ackSig)
 	default:
 		log.Printf("unsupported action: [%s]\n", msg.Action)
 	}
@@ -401,4 +899,13 @@ func (s *FileServer) handleMessageFileKey(from string, msg MessageFileKey) error
 func init() {
 	gob.Register(MessageStoreFile{})
 	gob.Register(MessageFileKey{})
+	gob.Register(MessageListKeys{})
+	gob.Register(MessageBucket{})
+	gob.Register(MessageHasKeys{})
+	gob.Register(MessageChunkRefs{})
+	gob.Register(MessageSignatures{})
+	gob.Register(MessageApplyDelta{})
+	gob.Register(MessageGetRange{})
+	gob.Register(MessageRotateKey{})
+	gob.Register(MessageRetireKeys{})
 }
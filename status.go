@@ -0,0 +1,35 @@
+package main
+
+import "sort"
+
+// NodeStatus summarizes what a node holds.
+type NodeStatus struct {
+	Addr     string
+	Peers    []string
+	Keys     int   // keys on disk, chunks and replicas included
+	Bytes    int64 // bytes on disk
+	Dedup    DedupStats
+	Cache    CacheStats
+	Scrub    ScrubStats
+	Rotation RotationStats
+}
+
+func (s *FileServer) Status() NodeStatus {
+	status := NodeStatus{
+		Addr:     s.Transport.ListenAddr(),
+		Dedup:    s.DedupStats(),
+		Cache:    s.CacheStats(),
+		Scrub:    s.ScrubStats(),
+		Rotation: s.RotationStats(),
+	}
+	for _, peer := range s.peerList() {
+		status.Peers = append(status.Peers, peer.RemoteAddr().String())
+	}
+	sort.Strings(status.Peers)
+
+	for _, entry := range s.store.index.Entries("") {
+		status.Keys++
+		status.Bytes += entry.Size
+	}
+	return status
+}
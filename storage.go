@@ -2,18 +2,66 @@ package main
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 // Default ROOT path
 const DEFAULT_ROOT_FOLDER_NAME string = "vasanthnetwork"
 
+// tempFileMarker marks the temp files objects are written to before they are
+// renamed into place. Any left on disk belong to writes that never finished.
+const tempFileMarker = ".tmp-"
+
+// quarantineDirName holds the files the scrubber found corrupt, moved out of
+// the way of reads but kept for inspection.
+const quarantineDirName = ".quarantine"
+
+var ErrIncompleteWrite = errors.New("incomplete write")
+
+// IntegrityError reports data that does not match the checksum it was stored
+// or sent with. It matches ErrChecksumMismatch.
+type IntegrityError struct {
+	Key  string
+	Want string // hex SHA-256 the data should have
+	Have string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("%s: [%s] has [%s] want [%s]", ErrChecksumMismatch, e.Key, e.Have, e.Want)
+}
+
+func (e *IntegrityError) Unwrap() error {
+	return ErrChecksumMismatch
+}
+
+// writeCheck is what the bytes written for a key must match before they
+// replace its file. Empty checksums are not checked.
+type writeCheck struct {
+	Checksum string // hex SHA-256 of the bytes on disk
+	Plain    string // hex SHA-256 of the original data
+
+	// Keys holds the key the bytes on disk are encrypted with, nil when they
+	// are the original data.
+	Keys *Keystore
+}
+
+// ObjectInfo describes a stored object by its original key.
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
 type PathKey struct {
 	PathName string
 	FileName string
@@ -68,6 +116,8 @@ type StoreOpts struct {
 
 type Store struct {
 	StoreOpts
+
+	index *Index
 }
 
 func NewStore(opts StoreOpts) *Store {
@@ -77,9 +127,33 @@ func NewStore(opts StoreOpts) *Store {
 	if len(opts.Root) == 0 {
 		opts.Root = DEFAULT_ROOT_FOLDER_NAME
 	}
-	return &Store{
+	s := &Store{
 		StoreOpts: opts,
 	}
+	s.openIndex()
+	return s
+}
+
+func (s *Store) openIndex() {
+	index, err := OpenIndex(fmt.Sprintf("%s/%s", s.Root, indexDirName))
+	if err != nil {
+		log.Fatalf("unable to open the index of [%s]: %s", s.Root, err)
+	}
+	s.index = index
+
+	report, err := s.Reconcile()
+	if err != nil {
+		log.Printf("[%s] unable to reconcile the index with the disk: %s\n", s.Root, err)
+		return
+	}
+	if report.Drifted() {
+		log.Printf("[%s] index drifted from disk: %+v\n", s.Root, report)
+	}
+}
+
+// Close flushes the index. The store must not be used afterwards.
+func (s *Store) Close() error {
+	return s.index.Close()
 }
 
 func (s *Store) Delete(key string) error {
@@ -88,52 +162,227 @@ func (s *Store) Delete(key string) error {
 	defer func() {
 		log.Printf("deleted [%s] from disk\n", pathKey.FileName)
 	}()
-	firstPathnameWithRoot := fmt.Sprintf("%s/%s", s.Root, pathKey.FirstPathName())
-	return os.RemoveAll(firstPathnameWithRoot)
+
+	// the key is gone from the index before its file, so a reader that finds
+	// it in the index does not race the removal for long
+	if err := s.index.Delete(key); err != nil {
+		return err
+	}
+	fullPathWithRoot := fmt.Sprintf("%s/%s", s.Root, pathKey.FullPath())
+	if err := os.Remove(fullPathWithRoot); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	s.pruneDirs(filepath.Dir(fullPathWithRoot))
+	return nil
+}
+
+// pruneDirs removes dir and its parents up to the root as long as they are
+// empty. Other keys may share a prefix of the path.
+func (s *Store) pruneDirs(dir string) {
+	root := filepath.Clean(s.Root)
+	for dir = filepath.Clean(dir); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
 }
 
 func (s *Store) Clear() error {
-	return os.RemoveAll(s.Root)
+	s.index.Close()
+	if err := os.RemoveAll(s.Root); err != nil {
+		return err
+	}
+	s.openIndex()
+	return nil
 }
 
 func (s *Store) Has(key string) bool {
-	pathKey := s.PathTransfromFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s", s.Root, pathKey.FullPath())
-	_, err := os.Stat(fullPathWithRoot)
-	return !errors.Is(err, os.ErrNotExist)
+	_, ok := s.index.Get(key)
+	return ok
+}
+
+// Stat returns the ObjectInfo of the object stored under key.
+func (s *Store) Stat(key string) (ObjectInfo, error) {
+	entry, ok := s.index.Get(key)
+	if !ok {
+		return ObjectInfo{}, fmt.Errorf("stat %s: %w", key, os.ErrNotExist)
+	}
+	return entry.Info(), nil
+}
+
+// List returns the ObjectInfo of every object whose original key starts with
+// prefix, sorted by key.
+func (s *Store) List(prefix string) ([]ObjectInfo, error) {
+	entries := s.index.Entries(prefix)
+	infos := make([]ObjectInfo, 0, len(entries))
+	for _, entry := range entries {
+		infos = append(infos, entry.Info())
+	}
+	return infos, nil
 }
 
 func (s *Store) Write(key string, r io.Reader) (int64, error) {
 	return s.writeStream(key, r)
 }
 
-func (s *Store) writeDecrypt(encKey []byte, key string, r io.Reader) (int, error) {
-	f, err := s.openFileForWriting(key)
-	if err != nil {
-		return 0, err
-	}
-	n, err := copyDecrypt(encKey, r, f)
+// writeObject stores r under key, indexed as the object name of the given
+// length. It is used for the copies of other nodes' objects, which are stored
+// under the hashed name, and for manifests.
+func (s *Store) writeObject(key, name string, length int64, r io.Reader) (int64, error) {
+	return s.writeVerified(key, name, length, writeCheck{}, r)
+}
+
+// writeVerified is writeObject keeping the file of key as it was unless the
+// bytes written pass check.
+func (s *Store) writeVerified(key, name string, length int64, check writeCheck, r io.Reader) (int64, error) {
+	return s.writeEntry(key, name, length, check, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+// writeDecrypt decrypts r into the file of key, indexed with the length of
+// the original object. The decrypted data must match plain unless it is empty.
+func (s *Store) writeDecrypt(keys *Keystore, key string, length int64, plain string, r io.Reader) (int, error) {
+	var n int
+	_, err := s.writeEntry(key, key, length, writeCheck{Plain: plain}, func(w io.Writer) (err error) {
+		n, err = copyDecrypt(keys, r, w)
+		return err
+	})
 	return n, err
 }
 
-func (s *Store) openFileForWriting(key string) (*os.File, error) {
+// createTemp creates the temp file the content of key is written to, in the
+// directory of the file of key so that it can be renamed into place.
+func (s *Store) createTemp(key string) (*os.File, error) {
 	pathKey := s.PathTransfromFunc(key)
-	pathKeyWithRoot := fmt.Sprintf("%s/%s", s.Root, pathKey.PathName)
+	fullPathWithRoot := fmt.Sprintf("%s/%s", s.Root, pathKey.FullPath())
+	dir := filepath.Dir(fullPathWithRoot)
 
-	if err := os.MkdirAll(pathKeyWithRoot, os.ModePerm); err != nil {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
 		return nil, err
 	}
+	return os.CreateTemp(dir, "."+filepath.Base(fullPathWithRoot)+tempFileMarker+"*")
+}
 
-	fullPathWithRoot := fmt.Sprintf("%s/%s", s.Root, pathKey.FullPath())
-	return os.Create(fullPathWithRoot)
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, tempFileMarker)
 }
 
 func (s *Store) writeStream(key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(key)
+	return s.writeEntry(key, key, -1, writeCheck{}, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+// writeEntry writes the file of key through copyFn and indexes it under name.
+// length is the length of the original object, which differs from the bytes
+// on disk for replicas and manifests. A negative length uses the bytes on disk.
+// The bytes go to a temp file that replaces the file of key only once it is
+// synced to disk and passes check. A failed write leaves the previous file of
+// key, if any, in place. The checksum of the original data is indexed along
+// with the one of the bytes on disk, for encrypted files it is taken while
+// decrypting them.
+func (s *Store) writeEntry(key, name string, length int64, check writeCheck, copyFn func(io.Writer) error) (int64, error) {
+	f, err := s.createTemp(key)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	hash, plainHash := sha256.New(), sha256.New()
+	w := io.MultiWriter(f, hash)
+	var dw *decryptWriter
+	if check.Keys != nil {
+		dw = &decryptWriter{keys: check.Keys, w: plainHash}
+		w = io.MultiWriter(w, dw)
+	}
+	if err := copyFn(w); err != nil {
+		return 0, err
+	}
+	if dw != nil {
+		if err := dw.Close(); err != nil {
+			return 0, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return 0, err
 	}
-	return io.Copy(f, r)
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	plain, keyID := sum, ""
+	if dw != nil {
+		plain, keyID = hex.EncodeToString(plainHash.Sum(nil)), dw.keyID()
+	}
+	if check.Checksum != "" && sum != check.Checksum {
+		return 0, &IntegrityError{Key: key, Want: check.Checksum, Have: sum}
+	}
+	if check.Plain != "" && plain != check.Plain {
+		return 0, &IntegrityError{Key: key, Want: check.Plain, Have: plain}
+	}
+	if length < 0 {
+		length = size
+	}
+
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	fullPathWithRoot := fmt.Sprintf("%s/%s", s.Root, s.PathTransfromFunc(key).FullPath())
+	if err := os.Rename(f.Name(), fullPathWithRoot); err != nil {
+		return 0, err
+	}
+	syncDir(filepath.Dir(fullPathWithRoot))
+
+	_, err = s.index.Put(IndexEntry{
+		Key:      key,
+		Name:     name,
+		PathKey:  s.PathTransfromFunc(key),
+		Size:     size,
+		Length:   length,
+		Checksum: sum,
+		Plain:    plain,
+		KeyID:    keyID,
+		ModTime:  time.Now(),
+	})
+	return size, err
+}
+
+// syncDir flushes the entries of dir, so that a file renamed into it survives
+// a crash.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	d.Sync()
+}
+
+// exactReader reads n bytes of r, failing with ErrIncompleteWrite when r ends
+// before, like a connection dropped halfway through a transfer.
+type exactReader struct {
+	r io.Reader
+	n int64
+}
+
+func (e *exactReader) Read(b []byte) (int, error) {
+	if e.n <= 0 {
+		return 0, io.EOF
+	}
+	n, err := e.r.Read(b[:min(int64(len(b)), e.n)])
+	e.n -= int64(n)
+	if err == io.EOF && e.n > 0 {
+		return n, fmt.Errorf("%w: stream ended %d bytes short", ErrIncompleteWrite, e.n)
+	}
+	return n, err
 }
 
 func (s *Store) Read(key string) (int64, io.Reader, error) {
@@ -156,3 +405,146 @@ func (s *Store) readStream(key string) (int64, io.ReadCloser, error) {
 
 	return fileinfo.Size(), file, err
 }
+
+// readSection reads up to n bytes of key starting at offset. It returns less
+// than n bytes only when key ends before.
+func (s *Store) readSection(key string, offset, n int64) ([]byte, error) {
+	pathKey := s.PathTransfromFunc(key)
+	f, err := os.Open(fmt.Sprintf("%s/%s", s.Root, pathKey.FullPath()))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, max(min(n, info.Size()-offset), 0))
+	read, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf[:read], nil
+}
+
+// verify reads the file of entry through wrap and checks it against the
+// checksum it was indexed with. It returns the bytes read, and an
+// IntegrityError if they do not match.
+func (s *Store) verify(entry IndexEntry, wrap func(io.Reader) io.Reader) (int64, error) {
+	f, err := os.Open(fmt.Sprintf("%s/%s", s.Root, entry.PathKey.FullPath()))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(hash, wrap(f))
+	if err != nil {
+		return n, err
+	}
+	if have := hex.EncodeToString(hash.Sum(nil)); have != entry.Checksum {
+		return n, &IntegrityError{Key: entry.Key, Want: entry.Checksum, Have: have}
+	}
+	return n, nil
+}
+
+// quarantine moves the file of key out of the store and returns where it went.
+// The key stays indexed, so its references survive until it is written again.
+func (s *Store) quarantine(key string) (string, error) {
+	pathKey := s.PathTransfromFunc(key)
+	dir := fmt.Sprintf("%s/%s", s.Root, quarantineDirName)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	fullPathWithRoot := fmt.Sprintf("%s/%s", s.Root, pathKey.FullPath())
+	dst := fmt.Sprintf("%s/%s-%d", dir, pathKey.FileName, time.Now().UnixNano())
+	if err := os.Rename(fullPathWithRoot, dst); err != nil {
+		return "", err
+	}
+	s.pruneDirs(filepath.Dir(fullPathWithRoot))
+	return dst, nil
+}
+
+// DriftReport lists the keys on which the index and the disk disagreed.
+type DriftReport struct {
+	Missing   []string // indexed, but the file is gone
+	Changed   []string // indexed with a different size than on disk, now marked corrupt
+	Untracked []string // paths on disk the index cannot map back to a key
+	Orphaned  []string // temp files of writes that never finished, now removed
+}
+
+func (r DriftReport) Drifted() bool {
+	return len(r.Missing)+len(r.Changed)+len(r.Untracked)+len(r.Orphaned) > 0
+}
+
+// Reconcile compares the index with the files on disk and repairs the index:
+// missing files are dropped and changed files are marked corrupt, so the
+// scrubber quarantines and repairs them. Files the index does not know are
+// only reported, since the path transform cannot be reversed. Temp files left
+// by writes cut short are removed, so Reconcile must not run while the store
+// is being written to.
+func (s *Store) Reconcile() (DriftReport, error) {
+	var report DriftReport
+
+	tracked := make(map[string]bool)
+	for _, entry := range s.index.Entries("") {
+		fullPathWithRoot := fmt.Sprintf("%s/%s", s.Root, entry.PathKey.FullPath())
+		tracked[filepath.Clean(fullPathWithRoot)] = true
+
+		fileinfo, err := os.Stat(fullPathWithRoot)
+		if errors.Is(err, os.ErrNotExist) {
+			report.Missing = append(report.Missing, entry.Key)
+			if err := s.index.Delete(entry.Key); err != nil {
+				return report, err
+			}
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+		if fileinfo.Size() != entry.Size {
+			report.Changed = append(report.Changed, entry.Key)
+			// the checksums are kept, the file is what no longer matches
+			entry.Corrupt = true
+			if _, err := s.index.Put(entry); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	indexDir := filepath.Clean(fmt.Sprintf("%s/%s", s.Root, indexDirName))
+	quarantineDir := filepath.Clean(fmt.Sprintf("%s/%s", s.Root, quarantineDirName))
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			if dir := filepath.Clean(path); dir == indexDir || dir == quarantineDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isTempFile(d.Name()) {
+			report.Orphaned = append(report.Orphaned, path)
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			s.pruneDirs(filepath.Dir(path))
+			return nil
+		}
+		// node metadata such as the bucket configs lives next to the objects
+		if strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		if !tracked[filepath.Clean(path)] {
+			report.Untracked = append(report.Untracked, path)
+		}
+		return nil
+	})
+	return report, err
+}
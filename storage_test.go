@@ -2,8 +2,14 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -59,6 +65,107 @@ func TestStore(t *testing.T) {
 
 }
 
+func TestStoreList(t *testing.T) {
+	s := newStore()
+	defer tearDown(t, s)
+
+	keys := []string{"docs/b", "docs/a", "pics/c"}
+	for _, key := range keys {
+		if _, err := s.Write(key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	infos, err := s.List("docs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Key != "docs/a" || infos[1].Key != "docs/b" {
+		t.Errorf("unexpected listing %+v", infos)
+	}
+
+	info, err := s.Stat("pics/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len("pics/c")) {
+		t.Errorf("have size %d want %d", info.Size, len("pics/c"))
+	}
+
+	page := paginate(infos, "docs/a", 10)
+	if len(page) != 1 || page[0].Key != "docs/b" {
+		t.Errorf("unexpected page %+v", page)
+	}
+}
+
+func TestStoreAtomicWrite(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransfromFunc: CASPathTransform})
+	defer s.Close()
+
+	if _, err := s.Write("doc", strings.NewReader("the first version")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a transfer dropped halfway
+	short := &exactReader{r: strings.NewReader("the sec"), n: 18}
+	if _, err := s.Write("doc", short); !errors.Is(err, ErrIncompleteWrite) {
+		t.Errorf("have %v want %v", err, ErrIncompleteWrite)
+	}
+	if _, err := s.writeVerified("doc", "doc", -1, writeCheck{Plain: "bad"}, strings.NewReader("the second version")); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("have %v want %v", err, ErrChecksumMismatch)
+	}
+
+	_, r, err := s.Read("doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.(io.Closer).Close()
+	if b, _ := io.ReadAll(r); string(b) != "the first version" {
+		t.Errorf("have %q want the first version kept", b)
+	}
+	if info, _ := s.Stat("doc"); info.Size != int64(len("the first version")) {
+		t.Errorf("have indexed size %d", info.Size)
+	}
+
+	dir := filepath.Dir(s.Root + "/" + CASPathTransform("doc").FullPath())
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("have %d files want the temp files removed", len(entries))
+	}
+}
+
+func TestWriteEncryptedReplica(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransfromFunc: CASPathTransform})
+	defer s.Close()
+
+	keys := NewKeystore(newEncryptionKey())
+	data := []byte("a replica only its original data vouches for")
+	wire := new(bytes.Buffer)
+	if _, err := copyEncrypt(keys.Active(), bytes.NewReader(data), wire); err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(data)
+	plain := hex.EncodeToString(hash[:])
+
+	// the key is not in this keystore, a key with its ID does not open it
+	wrong := NewKeystore(newEncryptionKey())
+	wrong.keys[keys.Active().ID] = wrong.keys[wrong.Active().ID]
+	check := writeCheck{Plain: plain, Keys: wrong}
+	if _, err := s.writeVerified("replica", "doc", -1, check, bytes.NewReader(wire.Bytes())); !errors.Is(err, ErrCorruptCiphertext) {
+		t.Errorf("have %v want %v for the wrong key", err, ErrCorruptCiphertext)
+	}
+	if s.Has("replica") {
+		t.Error("expected the replica to be dropped")
+	}
+
+	check.Keys = keys
+	if _, err := s.writeVerified("replica", "doc", -1, check, bytes.NewReader(wire.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := s.index.Get("replica"); entry.Plain != plain || entry.KeyID != keys.Active().ID {
+		t.Errorf("have plain checksum %s key %s want %s %s", entry.Plain, entry.KeyID, plain, keys.Active().ID)
+	}
+}
+
 // func TestDelete(t *testing.T) {
 // 	opts := StoreOpts{
 // 		PathTransfromFunc: CASPathTransform,
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+
+	"github.com/vasanthgk02/distributed_file_system/p2p"
+)
+
+// GetOpts tunes GetStream.
+type GetOpts struct {
+	// Cache writes the object through to the local store as it is read, so
+	// later reads are served from disk like after Get.
+	Cache bool
+}
+
+// GetStream returns the object under key as a stream decrypted straight off
+// the connection of the peer serving it. Unless opts.Cache is set nothing is
+// written to local disk, so reading a large object once leaves no copy of it
+// behind. Chunks are read one after the other, each from one peer, which is
+// held until its chunk is read. The stream must be closed.
+func (s *FileServer) GetStream(bucket, key string, opts GetOpts) (io.ReadCloser, error) {
+	cfg, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	key = objectKey(bucket, key)
+
+	s.account(key)
+	if opts.Cache && !s.store.Has(key) {
+		if err := s.fetch(cfg, key); err != nil {
+			return nil, err
+		}
+		s.cacheFetched(key)
+	}
+	rc, err := s.openCopy(cfg, key)
+	if err != nil {
+		return nil, err
+	}
+	manifest, ok, rest, err := readManifest(rc)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	if !ok {
+		return readCloser{Reader: rest, Closer: rc}, nil
+	}
+	rc.Close()
+
+	sr := &streamReader{
+		s:        s,
+		cfg:      cfg,
+		manifest: manifest,
+		chunks:   manifest.Chunks,
+		cache:    opts.Cache,
+	}
+	if manifest.Checksum == "" {
+		return sr, nil
+	}
+	return readCloser{
+		Reader: &verifyReader{r: sr, hash: sha256.New(), want: manifest.Checksum, key: key},
+		Closer: sr,
+	}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// streamReader streams the chunks of a manifest in order, verifying every
+// chunk against its ID as it passes.
+type streamReader struct {
+	s        *FileServer
+	cfg      BucketConfig
+	manifest Manifest
+	chunks   []ChunkRef
+	cache    bool
+
+	ref  ChunkRef
+	cur  io.ReadCloser
+	hash hash.Hash
+	buf  *bytes.Buffer // the chunk read so far, when caching
+}
+
+func (r *streamReader) Read(b []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			if err := r.next(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := r.cur.Read(b)
+		r.hash.Write(b[:n])
+		if r.buf != nil {
+			r.buf.Write(b[:n])
+		}
+		if err == io.EOF {
+			if err := r.finish(); err != nil {
+				return n, err
+			}
+			if n == 0 {
+				continue
+			}
+			return n, nil
+		}
+		return n, err
+	}
+}
+
+func (r *streamReader) next() error {
+	r.ref = r.chunks[0]
+	r.chunks = r.chunks[1:]
+	r.hash = sha256.New()
+	r.buf = nil
+
+	key := r.manifest.chunkKey(r.ref.ID)
+	r.s.account(key)
+	if r.cache && !r.s.store.Has(key) {
+		r.buf = new(bytes.Buffer)
+	}
+
+	var err error
+	if r.manifest.ErasureCoded() && !r.s.store.Has(key) {
+		var chunk []byte
+		chunk, err = r.s.reconstructChunk(r.cfg, r.manifest, r.ref)
+		r.cur = io.NopCloser(bytes.NewReader(chunk))
+	} else {
+		r.cur, err = r.s.openCopy(r.cfg, key)
+	}
+	if err != nil {
+		r.cur = nil
+	}
+	return err
+}
+
+// finish closes the chunk read to its end, and caches it once it checks out.
+func (r *streamReader) finish() error {
+	r.cur.Close()
+	r.cur = nil
+
+	if have := hex.EncodeToString(r.hash.Sum(nil)); have != r.ref.ID {
+		return &IntegrityError{Key: r.manifest.chunkKey(r.ref.ID), Want: r.ref.ID, Have: have}
+	}
+	if r.buf != nil {
+		key := r.manifest.chunkKey(r.ref.ID)
+		if _, err := r.s.store.Write(key, r.buf); err != nil {
+			return err
+		}
+		r.s.cacheFetched(key)
+	}
+	return nil
+}
+
+func (r *streamReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
+
+// openCopy opens the data of key from the local store, the replica of this
+// node or, failing both, the first peer holding a replica.
+func (s *FileServer) openCopy(cfg BucketConfig, key string) (io.ReadCloser, error) {
+	if _, r, err := s.store.readStream(key); err == nil {
+		return r, nil
+	}
+	if _, r, err := s.store.readStream(hashKey(key)); err == nil {
+		if !cfg.Encrypt {
+			return r, nil
+		}
+		dr, err := newDecryptReader(s.Keystore, r)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return readCloser{Reader: dr, Closer: r}, nil
+	}
+
+	// the peers placed for key rank first
+	for _, peer := range s.placePeers(key, 0) {
+		r, err := s.openFrom(peer, cfg, key)
+		if err != nil {
+			log.Printf("[%s] [%s] unavailable on [%s]: %s\n", s.Transport.ListenAddr(), key, peer.RemoteAddr(), err)
+			continue
+		}
+		return r, nil
+	}
+	return nil, fmt.Errorf("[%s] does not exist in network", key)
+}
+
+// openFrom asks peer for its replica of key and returns its reply as a
+// stream. The peer stays locked until the stream is closed.
+func (s *FileServer) openFrom(peer p2p.Peer, cfg BucketConfig, key string) (io.ReadCloser, error) {
+	return s.openKey(peer, hashKey(key), key, cfg.Encrypt)
+}
+
+// openKey is openFrom asking peer for the copy of key stored under wire,
+// which is decrypted if encrypted is set.
+func (s *FileServer) openKey(peer p2p.Peer, wire, key string, encrypted bool) (io.ReadCloser, error) {
+	msg := Message{
+		Payload: MessageFileKey{
+			Key:    wire,
+			Action: ACTION_GET,
+		},
+	}
+	unlock := s.lockPeers([]p2p.Peer{peer})
+	if err := s.send(peer, &msg); err != nil {
+		unlock()
+		return nil, err
+	}
+	if err := peer.AwaitStream(); err != nil {
+		unlock()
+		return nil, err
+	}
+
+	pr := &peerReader{peer: peer, unlock: unlock}
+	var filesize, length int64
+	if err := binary.Read(peer, binary.LittleEndian, &filesize); err != nil {
+		pr.Close()
+		return nil, err
+	}
+	if filesize == FILE_NOT_FOUND {
+		pr.Close()
+		return nil, fmt.Errorf("peer does not hold [%s]", key)
+	}
+	if err := binary.Read(peer, binary.LittleEndian, &length); err != nil {
+		pr.Close()
+		return nil, err
+	}
+	plain, err := readPlainSum(peer)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+
+	pr.body = io.LimitReader(peer, filesize)
+	pr.Reader = pr.body
+	if encrypted {
+		dr, err := newDecryptReader(s.Keystore, pr.body)
+		if err != nil {
+			pr.Close()
+			return nil, err
+		}
+		pr.Reader = dr
+	}
+	if plain != "" {
+		pr.Reader = &verifyReader{r: pr.Reader, hash: sha256.New(), want: plain, key: key}
+	}
+	return pr, nil
+}
+
+// peerReader reads a reply off the connection of a peer. Closing it skips
+// what is left of the reply and hands the connection back.
+type peerReader struct {
+	io.Reader
+	body   io.Reader
+	peer   p2p.Peer
+	unlock func()
+}
+
+func (r *peerReader) Close() error {
+	if r.peer == nil {
+		return nil
+	}
+	if r.body != nil {
+		io.Copy(io.Discard, r.body)
+	}
+	r.peer.CloseStream()
+	r.unlock()
+	r.peer = nil
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestGetStream(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	data := []byte("streamed from replicas without a local copy")
+	if err := s.Store(DefaultBucket, "doc", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// keep only encrypted replicas of the chunks, as if fetched from peers
+	manifest, _ := s.localManifest(objectKey(DefaultBucket, "doc"))
+	if !manifest.Encrypted {
+		t.Fatal("expected the default bucket to be encrypted")
+	}
+	var keys []string
+	for _, ref := range manifest.Chunks {
+		key := manifest.chunkKey(ref.ID)
+		chunk, err := s.readCopy(key, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc := new(bytes.Buffer)
+		copyEncrypt(s.Keystore.Active(), bytes.NewReader(chunk), enc)
+		if _, err := s.store.writeObject(hashKey(key), key, ref.Size, enc); err != nil {
+			t.Fatal(err)
+		}
+		s.store.Delete(key)
+		keys = append(keys, key)
+	}
+
+	for _, cache := range []bool{false, true} {
+		r, err := s.GetStream(DefaultBucket, "doc", GetOpts{Cache: cache})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(out, data) {
+			t.Errorf("cache %v: have %q %v want %q", cache, out, err, data)
+		}
+		for _, key := range keys {
+			if s.store.Has(key) != cache {
+				t.Errorf("cache %v: have local copy of [%s] %v", cache, key, !cache)
+			}
+		}
+	}
+}
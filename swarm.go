@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+
+	"github.com/vasanthgk02/distributed_file_system/p2p"
+)
+
+// A swarm downloads the chunks of an object from all peers at once. Every
+// peer gets a worker that fetches one chunk at a time from it, preferring the
+// chunks the peer was placed for. A chunk that fails on one peer goes back to
+// the queue for the others, and fails once every peer was tried.
+
+type swarmJob struct {
+	ref     ChunkRef
+	holders map[p2p.Peer]bool // peers placed for the chunk
+	tried   map[p2p.Peer]bool
+
+	done chan struct{} // closed once the chunk is on disk or failed
+	err  error
+}
+
+type swarm struct {
+	s     *FileServer
+	cfg   BucketConfig
+	m     Manifest
+	peers []p2p.Peer
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []*swarmJob
+	active  int // jobs being fetched
+	exited  int // workers that found no job left
+}
+
+// startSwarm starts fetching the chunks of m that are not on local disk and
+// returns the jobs by chunk ID. Erasure coded chunks are rebuilt by the
+// reader instead.
+func (s *FileServer) startSwarm(cfg BucketConfig, m Manifest) map[string]*swarmJob {
+	peers := s.peerList()
+	if m.ErasureCoded() || len(peers) == 0 {
+		return nil
+	}
+
+	w := &swarm{s: s, cfg: cfg, m: m, peers: peers}
+	w.cond = sync.NewCond(&w.mu)
+
+	jobs := make(map[string]*swarmJob)
+	for _, ref := range m.Chunks {
+		key := m.chunkKey(ref.ID)
+		if _, ok := jobs[ref.ID]; ok || s.store.Has(key) || s.store.Has(hashKey(key)) {
+			continue
+		}
+
+		job := &swarmJob{
+			ref:     ref,
+			holders: make(map[p2p.Peer]bool),
+			tried:   make(map[p2p.Peer]bool),
+			done:    make(chan struct{}),
+		}
+		// peers connected since the snapshot get no worker, so they cannot
+		// hold a job
+		for _, peer := range s.placePeers(key, cfg.ReplicationFactor) {
+			if slices.Contains(peers, peer) {
+				job.holders[peer] = true
+			}
+		}
+		jobs[ref.ID] = job
+		w.pending = append(w.pending, job)
+	}
+	if len(w.pending) == 0 {
+		return nil
+	}
+
+	for _, peer := range peers {
+		go w.work(peer)
+	}
+	return jobs
+}
+
+func (w *swarm) work(peer p2p.Peer) {
+	for {
+		job := w.next(peer)
+		if job == nil {
+			return
+		}
+		err := w.fetch(peer, job.ref)
+		w.finish(peer, job, err)
+	}
+}
+
+// next hands peer the first job it has not tried, waiting while other
+// workers may still put jobs back. It returns nil once no job is left for
+// peer. Jobs still pending once every worker is gone fail, so that no reader
+// waits on them forever.
+func (w *swarm) next(peer p2p.Peer) *swarmJob {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for {
+		for i, job := range w.pending {
+			if job.tried[peer] || (!job.holders[peer] && !job.triedHolders()) {
+				continue
+			}
+			w.pending = append(w.pending[:i], w.pending[i+1:]...)
+			job.tried[peer] = true
+			w.active++
+			return job
+		}
+		if w.active == 0 {
+			w.exited++
+			if w.exited == len(w.peers) {
+				for _, job := range w.pending {
+					job.err = fmt.Errorf("chunk [%s]: no peer left to fetch it from", job.ref.ID)
+					close(job.done)
+				}
+				w.pending = nil
+			}
+			return nil
+		}
+		w.cond.Wait()
+	}
+}
+
+func (w *swarm) finish(peer p2p.Peer, job *swarmJob, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	defer w.cond.Broadcast()
+
+	w.active--
+	switch {
+	case err == nil:
+		close(job.done)
+	case len(job.tried) == len(w.peers):
+		job.err = err
+		close(job.done)
+	default:
+		log.Printf("[%s] chunk [%s] failed on [%s], retrying on another peer: %s\n", w.s.Transport.ListenAddr(), job.ref.ID, peer.RemoteAddr(), err)
+		w.pending = append(w.pending, job)
+	}
+}
+
+func (j *swarmJob) triedHolders() bool {
+	for peer := range j.holders {
+		if !j.tried[peer] {
+			return false
+		}
+	}
+	return true
+}
+
+// fetch gets a chunk from peer and verifies it against its ID.
+func (w *swarm) fetch(peer p2p.Peer, ref ChunkRef) error {
+	key := w.m.chunkKey(ref.ID)
+	if err := w.s.fetchFrom(peer, w.cfg, key, ref.ID); err != nil {
+		return fmt.Errorf("chunk [%s] from [%s]: %w", ref.ID, peer.RemoteAddr(), err)
+	}
+	w.s.cacheFetched(key)
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/vasanthgk02/distributed_file_system/p2p"
+)
+
+type fakePeer struct {
+	p2p.Peer
+	port int
+}
+
+func (p *fakePeer) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: p.port}
+}
+
+func TestSwarmRetry(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	a, b := &fakePeer{port: 1}, &fakePeer{port: 2}
+	w := &swarm{s: s, peers: []p2p.Peer{a, b}}
+	w.cond = sync.NewCond(&w.mu)
+
+	job := &swarmJob{
+		holders: map[p2p.Peer]bool{a: true},
+		tried:   make(map[p2p.Peer]bool),
+		done:    make(chan struct{}),
+	}
+	w.pending = []*swarmJob{job}
+
+	// b is no holder and waits for a, a fails and hands the job to b
+	got := make(chan *swarmJob)
+	go func() { got <- w.next(b) }()
+	if w.next(a) != job {
+		t.Fatal("expected the holder to get the job first")
+	}
+	w.finish(a, job, errors.New("broken"))
+	if <-got != job {
+		t.Fatal("expected the job to be retried on the other peer")
+	}
+
+	// every peer failed, the job fails
+	w.finish(b, job, errors.New("broken"))
+	<-job.done
+	if job.err == nil {
+		t.Error("expected the job to fail once every peer was tried")
+	}
+	if w.next(a) != nil || w.next(b) != nil {
+		t.Error("expected no job left")
+	}
+}
+
+func TestSwarmNoWorkerLeft(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	// c was placed for the chunk but has no worker, a only waits for it
+	a, c := &fakePeer{port: 1}, &fakePeer{port: 3}
+	w := &swarm{s: s, peers: []p2p.Peer{a}}
+	w.cond = sync.NewCond(&w.mu)
+
+	job := &swarmJob{
+		holders: map[p2p.Peer]bool{c: true},
+		tried:   make(map[p2p.Peer]bool),
+		done:    make(chan struct{}),
+	}
+	w.pending = []*swarmJob{job}
+
+	if w.next(a) != nil {
+		t.Fatal("expected no job for a peer that is no holder")
+	}
+	<-job.done
+	if job.err == nil {
+		t.Error("expected the job to fail once the last worker exited")
+	}
+}
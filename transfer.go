@@ -0,0 +1,375 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable transfers record their progress a chunk at a time, so an upload
+// or download cut off halfway resumes at the first chunk it did not finish
+// instead of starting over. The chunks an upload stored are referenced by the
+// transfer until the object is committed, so they survive until it resumes
+// and are released when it is aborted.
+
+const transfersFileName = ".transfers.json"
+
+var ErrUnknownTransfer = errors.New("unknown transfer")
+
+type TransferKind string
+
+const (
+	TransferUpload   TransferKind = "upload"
+	TransferDownload TransferKind = "download"
+)
+
+// Transfer is the progress of a resumable upload or download.
+type Transfer struct {
+	ID     string
+	Kind   TransferKind
+	Bucket string
+	Key    string
+	Offset int64  // bytes stored or written so far, always at a chunk boundary
+	Path   string // file a download writes to
+
+	// Manifest lists the chunks an upload stored so far, cut by Chunking.
+	// For a download it is the manifest of the object being downloaded.
+	Manifest Manifest
+	Chunking Chunking
+
+	Updated time.Time
+}
+
+func newTransferID() string {
+	buf := make([]byte, 8)
+	io.ReadFull(rand.Reader, buf)
+	return hex.EncodeToString(buf)
+}
+
+// transferRef is the object name the chunks of an upload are referenced by
+// until the upload completes.
+func transferRef(id string) string {
+	return objectKey(".transfers", id)
+}
+
+// TransferRegistry persists the unfinished transfers of a node.
+type TransferRegistry struct {
+	mu        sync.RWMutex
+	path      string
+	transfers map[string]Transfer
+}
+
+func NewTransferRegistry(root string) *TransferRegistry {
+	r := &TransferRegistry{
+		path:      fmt.Sprintf("%s/%s", root, transfersFileName),
+		transfers: make(map[string]Transfer),
+	}
+
+	b, err := os.ReadFile(r.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("unable to read transfers: %s\n", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &r.transfers); err != nil {
+			log.Printf("unable to decode transfers: %s\n", err)
+		}
+	}
+	return r
+}
+
+func (r *TransferRegistry) Get(id string) (Transfer, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	t, ok := r.transfers[id]
+	return t, ok
+}
+
+func (r *TransferRegistry) All() []Transfer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ts := make([]Transfer, 0, len(r.transfers))
+	for _, t := range r.transfers {
+		ts = append(ts, t)
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].Updated.Before(ts[j].Updated) })
+	return ts
+}
+
+func (r *TransferRegistry) Put(t Transfer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t.Updated = time.Now()
+	r.transfers[t.ID] = t
+	return r.save()
+}
+
+func (r *TransferRegistry) Delete(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.transfers, id)
+	return r.save()
+}
+
+func (r *TransferRegistry) save() error {
+	b, err := json.Marshal(r.transfers)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(strings.TrimSuffix(r.path, transfersFileName), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(r.path, b, 0644)
+}
+
+// Transfers lists the unfinished transfers of this node, least recently
+// updated first.
+func (s *FileServer) Transfers() []Transfer {
+	return s.transfers.All()
+}
+
+func (s *FileServer) transfer(id string, kind TransferKind) (Transfer, error) {
+	t, ok := s.transfers.Get(id)
+	if !ok || t.Kind != kind {
+		return t, fmt.Errorf("%w: %s %s", ErrUnknownTransfer, kind, id)
+	}
+	return t, nil
+}
+
+// StoreResumable is StoreWithOpts recording its progress under a transfer ID.
+// The ID is returned even when the store fails, ResumeUpload then finishes it.
+func (s *FileServer) StoreResumable(bucket, key string, r io.Reader, opts ObjectOpts) (string, error) {
+	cfg, err := s.bucket(bucket)
+	if err != nil {
+		return "", err
+	}
+	if err := validChunking(opts.Chunking); err != nil {
+		return "", err
+	}
+
+	t := Transfer{
+		ID:       newTransferID(),
+		Kind:     TransferUpload,
+		Bucket:   bucket,
+		Key:      key,
+		Manifest: newManifest(cfg),
+		Chunking: cmp.Or(opts.Chunking, cfg.Chunking),
+	}
+	if err := s.transfers.Put(t); err != nil {
+		return "", err
+	}
+	return t.ID, s.upload(cfg, &t, r, sha256.New())
+}
+
+// ResumeUpload finishes an upload from the first chunk it did not store. r
+// must hold the content the upload started with. What was already stored is
+// read again to checksum the object, but not sent again.
+func (s *FileServer) ResumeUpload(id string, r io.ReadSeeker) error {
+	t, err := s.transfer(id, TransferUpload)
+	if err != nil {
+		return err
+	}
+	cfg, err := s.bucket(t.Bucket)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(hash, r, t.Offset); err != nil {
+		return fmt.Errorf("reading the %d bytes already uploaded: %w", t.Offset, err)
+	}
+	log.Printf("[%s] resuming upload %s of [%s] at %d bytes\n", s.Transport.ListenAddr(), id, t.Key, t.Offset)
+	return s.upload(cfg, &t, r, hash)
+}
+
+func (s *FileServer) upload(cfg BucketConfig, t *Transfer, r io.Reader, hash hash.Hash) error {
+	key := objectKey(t.Bucket, t.Key)
+	ref := transferRef(t.ID)
+
+	old, _ := s.localManifest(key)
+	// the chunks are held by the transfer until the object references them
+	c := s.limitChunks(cfg, t.Bucket, key, t.Manifest.Size, s.chunker(t.Chunking, r))
+	manifest, err := s.storeChunksFrom(cfg, c, old, t.Manifest, hash, ref, func(m Manifest) error {
+		t.Manifest, t.Offset = m, m.Size
+		return s.transfers.Put(*t)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.commitObject(cfg, t.Bucket, key, manifest); err != nil {
+		return err
+	}
+	if err := s.release(ref, manifest); err != nil {
+		return err
+	}
+	return s.transfers.Delete(t.ID)
+}
+
+// Download writes the object under key to the file at path, recording its
+// progress under a transfer ID. The ID is returned even when the download
+// fails, ResumeDownload then finishes it.
+func (s *FileServer) Download(bucket, key, path string) (string, error) {
+	if _, err := s.bucket(bucket); err != nil {
+		return "", err
+	}
+
+	t := Transfer{
+		ID:     newTransferID(),
+		Kind:   TransferDownload,
+		Bucket: bucket,
+		Key:    key,
+		Path:   path,
+	}
+	if err := s.transfers.Put(t); err != nil {
+		return "", err
+	}
+	return t.ID, s.download(&t)
+}
+
+// ResumeDownload finishes a download from the first chunk it did not write.
+// If the object changed in the meantime, the download starts over.
+func (s *FileServer) ResumeDownload(id string) error {
+	t, err := s.transfer(id, TransferDownload)
+	if err != nil {
+		return err
+	}
+	log.Printf("[%s] resuming download %s of [%s] at %d bytes\n", s.Transport.ListenAddr(), id, t.Key, t.Offset)
+	return s.download(&t)
+}
+
+func (s *FileServer) download(t *Transfer) error {
+	cfg, err := s.bucket(t.Bucket)
+	if err != nil {
+		return err
+	}
+	key := objectKey(t.Bucket, t.Key)
+
+	s.account(key)
+	if !s.store.Has(key) {
+		if err := s.fetch(cfg, key); err != nil {
+			return err
+		}
+		s.cacheFetched(key)
+	}
+	_, r, err := s.store.readStream(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	manifest, ok, rest, err := readManifest(r)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(t.Path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if !ok {
+		// objects stored before chunking are copied in one go
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, rest); err != nil {
+			return err
+		}
+		return s.transfers.Delete(t.ID)
+	}
+
+	if manifest.Checksum != t.Manifest.Checksum || !slices.Equal(manifest.Chunks, t.Manifest.Chunks) {
+		if t.Offset > 0 {
+			log.Printf("[%s] [%s] changed since download %s started, starting over\n", s.Transport.ListenAddr(), key, t.ID)
+		}
+		t.Offset, t.Manifest = 0, manifest
+	}
+	if err := f.Truncate(t.Offset); err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if _, err := io.CopyN(hash, f, t.Offset); err != nil {
+		return err
+	}
+
+	var (
+		pos  int64
+		left = manifest
+	)
+	left.Chunks = nil
+	for i, ref := range manifest.Chunks {
+		if pos == t.Offset {
+			left.Chunks = manifest.Chunks[i:]
+			break
+		}
+		pos += ref.Size
+	}
+
+	cr := &chunkReader{
+		s:        s,
+		cfg:      cfg,
+		manifest: manifest,
+		jobs:     s.startSwarm(cfg, left),
+	}
+	for _, ref := range left.Chunks {
+		s.account(manifest.chunkKey(ref.ID))
+		chunk, err := cr.open(ref)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(io.MultiWriter(f, hash), chunk)
+		chunk.Close()
+		if err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		t.Offset += ref.Size
+		if err := s.transfers.Put(*t); err != nil {
+			return err
+		}
+	}
+
+	if have := hex.EncodeToString(hash.Sum(nil)); manifest.Checksum != "" && have != manifest.Checksum {
+		t.Offset = 0
+		s.transfers.Put(*t)
+		return &IntegrityError{Key: key, Want: manifest.Checksum, Have: have}
+	}
+	return s.transfers.Delete(t.ID)
+}
+
+// AbortTransfer forgets an unfinished transfer. The chunks an upload stored
+// are released, the file of a download is left as it is.
+func (s *FileServer) AbortTransfer(id string) error {
+	t, ok := s.transfers.Get(id)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownTransfer, id)
+	}
+	if t.Kind == TransferUpload {
+		if err := s.release(transferRef(id), t.Manifest); err != nil {
+			return err
+		}
+	}
+	return s.transfers.Delete(id)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// failingReader fails once n bytes were read, like a dropped connection.
+type failingReader struct {
+	r io.Reader
+	n int
+}
+
+func (f *failingReader) Read(b []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, errors.New("connection dropped")
+	}
+	n, err := f.r.Read(b[:min(len(b), f.n)])
+	f.n -= n
+	return n, err
+}
+
+func TestResumeUpload(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	data := []byte("an upload that drops halfway through and resumes")
+	id, err := s.StoreResumable(DefaultBucket, "doc", &failingReader{r: bytes.NewReader(data), n: 20}, ObjectOpts{})
+	if err == nil {
+		t.Fatal("expected the upload to fail")
+	}
+	tr, ok := s.transfers.Get(id)
+	if !ok || tr.Offset != 16 || len(tr.Manifest.Chunks) != 2 {
+		t.Fatalf("have transfer %+v want 2 chunks stored", tr)
+	}
+
+	if err := s.ResumeUpload(id, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.Get(DefaultBucket, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := io.ReadAll(r); err != nil || !bytes.Equal(out, data) {
+		t.Errorf("have %q %v want %q", out, err, data)
+	}
+	if len(s.Transfers()) != 0 {
+		t.Error("expected the transfer to be done")
+	}
+	if stats := s.DedupStats(); stats.Refs != stats.Chunks {
+		t.Errorf("have %d refs to %d chunks, want the transfer references released", stats.Refs, stats.Chunks)
+	}
+
+	if err := s.ResumeUpload(id, bytes.NewReader(data)); !errors.Is(err, ErrUnknownTransfer) {
+		t.Errorf("have %v want %v", err, ErrUnknownTransfer)
+	}
+}
+
+func TestResumeDownload(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	data := []byte("a download resumed after its first two chunks")
+	if err := s.Store(DefaultBucket, "doc", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	manifest, _ := s.localManifest(objectKey(DefaultBucket, "doc"))
+
+	// two chunks made it to disk, followed by a torn write
+	path := filepath.Join(t.TempDir(), "doc")
+	if err := os.WriteFile(path, append(bytes.Clone(data[:16]), "torn"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tr := Transfer{
+		ID:       newTransferID(),
+		Kind:     TransferDownload,
+		Bucket:   DefaultBucket,
+		Key:      "doc",
+		Offset:   16,
+		Path:     path,
+		Manifest: manifest,
+	}
+	if err := s.transfers.Put(tr); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.ResumeDownload(tr.ID); err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := os.ReadFile(path); !bytes.Equal(out, data) {
+		t.Errorf("have %q want %q", out, data)
+	}
+	if len(s.Transfers()) != 0 {
+		t.Error("expected the transfer to be done")
+	}
+}